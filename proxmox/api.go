@@ -0,0 +1,247 @@
+package proxmox
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	pxapi "github.com/enix/proxmox-api-go/proxmox"
+)
+
+// apiClient gives access to the API endpoints that pxapi does not cover,
+// sharing the credentials of the pxapi client.
+type apiClient struct {
+	url        string
+	httpClient *http.Client
+	headers    http.Header
+}
+
+func newApiClient(apiUrl string, tlsConfig *tls.Config) *apiClient {
+	return &apiClient{
+		url: strings.TrimRight(apiUrl, "/"),
+		httpClient: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			Timeout:   60 * time.Second,
+		},
+		headers: http.Header{},
+	}
+}
+
+func (api *apiClient) setTicket(ticket *apiTicket) {
+	api.headers.Set("Cookie", "PVEAuthCookie="+ticket.Ticket)
+	api.headers.Set("CSRFPreventionToken", ticket.CsrfToken)
+}
+
+func (api *apiClient) setToken(tokenId string, tokenSecret string) {
+	api.headers.Set("Authorization", fmt.Sprintf("PVEAPIToken=%s=%s", tokenId, tokenSecret))
+}
+
+// Connect both the pxapi client and the apiClient. Password logins are done
+// here, so that a two-factor code is only used once and the ticket can be
+// cached in ticketFile.
+func connectApi(pxConfig *pxapi.Configuration, otp string, ticketFile string) (*pxapi.Client, *apiClient, error) {
+	api := newApiClient(pxConfig.Url, pxConfig.TlsConfig)
+	if pxConfig.TokenId != "" {
+		api.setToken(pxConfig.TokenId, pxConfig.TokenSecret)
+	} else {
+		ticket, err := getTicket(
+			pxConfig.Url,
+			pxConfig.TlsConfig,
+			pxConfig.Username,
+			pxConfig.Password,
+			otp,
+			ticketFile,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		api.setTicket(ticket)
+		pxConfig.Password = ""
+		pxConfig.Ticket = ticket.Ticket
+		pxConfig.CsrfToken = ticket.CsrfToken
+	}
+
+	// authenticated already, by the token or the ticket
+	client, err := pxapi.NewClient(pxConfig, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, api, nil
+}
+
+func (api *apiClient) get(path string, params map[string]interface{}) (interface{}, error) {
+	return api.request("GET", path, params)
+}
+
+func (api *apiClient) post(path string, params map[string]interface{}) (interface{}, error) {
+	return api.request("POST", path, params)
+}
+
+func (api *apiClient) put(path string, params map[string]interface{}) (interface{}, error) {
+	return api.request("PUT", path, params)
+}
+
+func (api *apiClient) delete(path string, params map[string]interface{}) (interface{}, error) {
+	return api.request("DELETE", path, params)
+}
+
+// Send a request and return the `data` member of the response.
+func (api *apiClient) request(method string, path string, params map[string]interface{}) (interface{}, error) {
+	response, err := api.send(method, path, params)
+	if err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+// Get a page of a list, along with the total number of items, for endpoints
+// that take start and limit parameters.
+func (api *apiClient) getPage(path string, start int, limit int) ([]interface{}, int, error) {
+	response, err := api.send("GET", path, map[string]interface{}{"start": start, "limit": limit})
+	if err != nil {
+		return nil, 0, err
+	}
+	items, _ := response.Data.([]interface{})
+	return items, response.Total, nil
+}
+
+func (api *apiClient) send(method string, path string, params map[string]interface{}) (*apiResponse, error) {
+	values := params2Values(params)
+	reqUrl := api.url + path
+	var body io.Reader
+	if method == "POST" || method == "PUT" {
+		body = strings.NewReader(values.Encode())
+	} else if len(values) > 0 {
+		reqUrl += "?" + values.Encode()
+	}
+
+	req, err := http.NewRequest(method, reqUrl, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range api.headers {
+		req.Header[key] = value
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return api.do(api.httpClient, req)
+}
+
+// Upload a file as multipart form data, streamed as it can be a multi-GB
+// image. The request is bound by the deadline instead of the client timeout.
+func (api *apiClient) upload(path string, params map[string]interface{}, fileField string, filename string, file io.Reader, dl deadline) (interface{}, error) {
+	bodyReader, bodyWriter := io.Pipe()
+	// unblock the writer if the request fails before reading the whole body
+	defer bodyReader.Close()
+	form := multipart.NewWriter(bodyWriter)
+	go func() {
+		for key, values := range params2Values(params) {
+			for _, value := range values {
+				if err := form.WriteField(key, value); err != nil {
+					bodyWriter.CloseWithError(err)
+					return
+				}
+			}
+		}
+		part, err := form.CreateFormFile(fileField, filename)
+		if err == nil {
+			_, err = io.Copy(part, file)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		bodyWriter.CloseWithError(err)
+	}()
+
+	ctx, cancel := context.WithDeadline(context.Background(), dl.time)
+	defer cancel()
+	req, err := http.NewRequest("POST", api.url+path, bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for key, value := range api.headers {
+		req.Header[key] = value
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	uploadClient := *api.httpClient
+	uploadClient.Timeout = 0
+	response, err := api.do(&uploadClient, req)
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, dl.errorf("uploading %s", filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+type apiResponse struct {
+	Data   interface{}       `json:"data"`
+	Total  int               `json:"total"`
+	Errors map[string]string `json:"errors"`
+}
+
+func (api *apiClient) do(httpClient *http.Client, req *http.Request) (*apiResponse, error) {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var response apiResponse
+	// error responses are not always JSON
+	jsonErr := json.Unmarshal(content, &response)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		if len(response.Errors) > 0 {
+			return nil, fmt.Errorf("%s %s: %s %v", req.Method, req.URL.Path, resp.Status, response.Errors)
+		}
+		return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	if jsonErr != nil {
+		return nil, jsonErr
+	}
+	return &response, nil
+}
+
+// Proxmox expects booleans as 0/1.
+func params2Values(params map[string]interface{}) url.Values {
+	values := url.Values{}
+	for key, value := range params {
+		switch v := value.(type) {
+		case bool:
+			if v {
+				values.Set(key, "1")
+			} else {
+				values.Set(key, "0")
+			}
+		case []string:
+			for _, item := range v {
+				values.Add(key, item)
+			}
+		default:
+			values.Set(key, fmt.Sprint(v))
+		}
+	}
+	return values
+}
+
+// Path of a qemu VM or lxc container, depending on the type of vmr.
+func vmPath(vmr *pxapi.VmRef) string {
+	return fmt.Sprintf("/nodes/%s/%s/%d", vmr.Node(), vmr.GetVmType(), vmr.VmId())
+}
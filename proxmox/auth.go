@@ -0,0 +1,147 @@
+package proxmox
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Proxmox tickets are valid for two hours, keep a margin before reusing one.
+const ticketLifetime = 110 * time.Minute
+
+type apiTicket struct {
+	Url       string    `json:"url"`
+	Username  string    `json:"username"`
+	Ticket    string    `json:"ticket"`
+	CsrfToken string    `json:"csrf_token"`
+	Created   time.Time `json:"created"`
+}
+
+// Get a ticket for username, either from the cache file or by logging in,
+// in which case the cache file is refreshed.
+func getTicket(apiUrl string, tlsConfig *tls.Config, username string, password string, otp string, ticketFile string) (ticket *apiTicket, err error) {
+	if ticketFile != "" {
+		ticket, err = readTicketFile(ticketFile)
+		if err != nil {
+			log.Printf("[DEBUG] ignoring ticket file %s: %v", ticketFile, err)
+		} else if ticket.Url == apiUrl && ticket.Username == username && time.Since(ticket.Created) < ticketLifetime {
+			log.Print("[DEBUG] reusing cached ticket")
+			return ticket, nil
+		}
+	}
+
+	ticket, err = login(apiUrl, tlsConfig, username, password, otp)
+	if err != nil {
+		return nil, err
+	}
+	if ticketFile != "" {
+		err = writeTicketFile(ticketFile, ticket)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ticket, nil
+}
+
+// Log in through /access/ticket, answering the TOTP challenge when the realm
+// requires a second factor.
+func login(apiUrl string, tlsConfig *tls.Config, username string, password string, otp string) (*apiTicket, error) {
+	httpClient := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		Timeout:   30 * time.Second,
+	}
+
+	params := url.Values{
+		"username": {username},
+		"password": {password},
+	}
+	if otp != "" {
+		// accepted along the password by realms with legacy TFA
+		params.Set("otp", otp)
+	}
+	data, err := postTicket(httpClient, apiUrl, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if needTFA, ok := data["NeedTFA"]; ok && fmt.Sprint(needTFA) != "0" {
+		if otp == "" {
+			return nil, fmt.Errorf("Two-factor authentication required for %s, set api_otp or PM_OTP", username)
+		}
+		params = url.Values{
+			"username":      {username},
+			"tfa-challenge": {fmt.Sprint(data["ticket"])},
+			"password":      {"totp:" + otp},
+		}
+		data, err = postTicket(httpClient, apiUrl, params)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ticket, isString := data["ticket"].(string)
+	if !isString || ticket == "" {
+		return nil, fmt.Errorf("Login failed for %s: no ticket in response", username)
+	}
+	csrfToken, _ := data["CSRFPreventionToken"].(string)
+	return &apiTicket{
+		Url:       apiUrl,
+		Username:  username,
+		Ticket:    ticket,
+		CsrfToken: csrfToken,
+		Created:   time.Now(),
+	}, nil
+}
+
+func postTicket(httpClient *http.Client, apiUrl string, params url.Values) (map[string]interface{}, error) {
+	resp, err := httpClient.Post(
+		strings.TrimRight(apiUrl, "/")+"/access/ticket",
+		"application/x-www-form-urlencoded",
+		strings.NewReader(params.Encode()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Login failed for %s: %s", params.Get("username"), resp.Status)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return nil, err
+	}
+	if body.Data == nil {
+		return nil, fmt.Errorf("Login failed for %s", params.Get("username"))
+	}
+	return body.Data, nil
+}
+
+func readTicketFile(ticketFile string) (*apiTicket, error) {
+	content, err := ioutil.ReadFile(ticketFile)
+	if err != nil {
+		return nil, err
+	}
+	ticket := &apiTicket{}
+	err = json.Unmarshal(content, ticket)
+	return ticket, err
+}
+
+func writeTicketFile(ticketFile string, ticket *apiTicket) error {
+	content, err := json.Marshal(ticket)
+	if err != nil {
+		return err
+	}
+	// the ticket grants the same rights as the password
+	return ioutil.WriteFile(ticketFile, content, os.FileMode(0600))
+}
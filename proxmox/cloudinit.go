@@ -0,0 +1,158 @@
+package proxmox
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	pxapi "github.com/enix/proxmox-api-go/proxmox"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// Custom cloud-init data arguments, by their cicustom type.
+var cloudInitDataArgs = []struct{ arg, kind string }{
+	{"cloudinit_user_data", "user"},
+	{"cloudinit_network_data", "network"},
+	{"cloudinit_vendor_data", "vendor"},
+	{"cloudinit_meta_data", "meta"},
+}
+
+// Arguments that end up in the cloud-init drive, besides the custom data.
+var cloudInitArgs = []string{
+	"cloudinit_user",
+	"cloudinit_password",
+	"cloudinit_searchdomain",
+	"cloudinit_nameserver",
+	"cloudinit_sshkeys",
+	"cloudinit_ipconfig0",
+	"cloudinit_ipconfig1",
+	"ipconfig",
+	"nameservers",
+	"search_domains",
+	"ssh_keys",
+}
+
+func hasCloudInitChange(d *schema.ResourceData) bool {
+	for _, arg := range cloudInitArgs {
+		if d.HasChange(arg) {
+			return true
+		}
+	}
+	return hasCloudInitCustomChange(d)
+}
+
+func hasCloudInitCustomChange(d *schema.ResourceData) bool {
+	if d.HasChange("cloudinit_snippets_storage") {
+		return true
+	}
+	for _, c := range cloudInitDataArgs {
+		if d.HasChange(c.arg) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasCloudInitDrive(apiConfig map[string]interface{}) bool {
+	for key, value := range apiConfig {
+		if rxDriveKey.MatchString(key) && strings.Contains(fmt.Sprint(value), "cloudinit") {
+			return true
+		}
+	}
+	return false
+}
+
+var rxDriveKey = regexp.MustCompile("^(ide|sata|scsi)[0-9]+$")
+
+// A value is either a snippet volume id, or inline content written by the
+// provider to a snippet named after the VM.
+func cloudInitSnippetName(vmId int, kind string) string {
+	return fmt.Sprintf("vm-%d-cloudinit-%s.yaml", vmId, kind)
+}
+
+// Write the inline cloud-init data as snippets and point cicustom to them,
+// along with the referenced ones.
+func setCloudInitCustom(d *schema.ResourceData, pconf *providerConfiguration, vmr *pxapi.VmRef, dl deadline) error {
+	storage := d.Get("cloudinit_snippets_storage").(string)
+	custom := []string{}
+	for _, c := range cloudInitDataArgs {
+		value := d.Get(c.arg).(string)
+		if value == "" {
+			continue
+		}
+		volumeId := value
+		if !isSnippetVolume(value) {
+			if storage == "" {
+				return fmt.Errorf("cloudinit_snippets_storage is required for inline %s", c.arg)
+			}
+			var err error
+			volumeId, err = writeSnippet(pconf, vmr.Node(), storage, cloudInitSnippetName(vmr.VmId(), c.kind), value, dl)
+			if err != nil {
+				return err
+			}
+		}
+		custom = append(custom, c.kind+"="+volumeId)
+	}
+
+	params := map[string]interface{}{}
+	if len(custom) > 0 {
+		params["cicustom"] = strings.Join(custom, ",")
+	} else {
+		params["delete"] = "cicustom"
+	}
+	return setQemuConfig(pconf.Api, vmr, params, dl)
+}
+
+// Delete the snippets written for inline data that is not used anymore,
+// either removed, replaced by a reference or moved to another storage.
+func deleteStaleCloudInitSnippets(d *schema.ResourceData, api *apiClient, vmr *pxapi.VmRef) {
+	oldStorage, newStorage := d.GetChange("cloudinit_snippets_storage")
+	for _, c := range cloudInitDataArgs {
+		oldValue, newValue := d.GetChange(c.arg)
+		if oldValue == "" || isSnippetVolume(oldValue.(string)) {
+			continue
+		}
+		if newValue != "" && !isSnippetVolume(newValue.(string)) && oldStorage == newStorage {
+			continue
+		}
+		volumeId := fmt.Sprintf("%s:snippets/%s", oldStorage, cloudInitSnippetName(vmr.VmId(), c.kind))
+		if err := deleteSnippet(api, vmr.Node(), volumeId); err != nil {
+			log.Printf("[WARN] cannot delete snippet %s: %v", volumeId, err)
+		}
+	}
+}
+
+// Delete all the snippets written for inline data, once the VM is gone.
+func deleteCloudInitSnippets(d *schema.ResourceData, api *apiClient, vmr *pxapi.VmRef) {
+	storage := d.Get("cloudinit_snippets_storage").(string)
+	for _, c := range cloudInitDataArgs {
+		value := d.Get(c.arg).(string)
+		if value == "" || isSnippetVolume(value) {
+			continue
+		}
+		volumeId := fmt.Sprintf("%s:snippets/%s", storage, cloudInitSnippetName(vmr.VmId(), c.kind))
+		if err := deleteSnippet(api, vmr.Node(), volumeId); err != nil {
+			log.Printf("[WARN] cannot delete snippet %s: %v", volumeId, err)
+		}
+	}
+}
+
+// Refresh the snippet references from cicustom. Inline data cannot be read
+// back and is kept as is.
+func updateCloudInitCustom(d *schema.ResourceData, apiConfig map[string]interface{}) {
+	custom := map[string]string{}
+	if cicustom, ok := apiConfig["cicustom"].(string); ok {
+		for _, part := range strings.Split(cicustom, ",") {
+			kindVolume := strings.SplitN(part, "=", 2)
+			if len(kindVolume) == 2 {
+				custom[kindVolume[0]] = kindVolume[1]
+			}
+		}
+	}
+	for _, c := range cloudInitDataArgs {
+		if isSnippetVolume(d.Get(c.arg).(string)) {
+			d.Set(c.arg, custom[c.kind])
+		}
+	}
+}
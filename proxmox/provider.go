@@ -2,19 +2,26 @@ package proxmox
 
 import (
 	"fmt"
+	"log"
 	"regexp"
 	"strconv"
 	"sync"
+	"time"
 
 	pxapi "github.com/enix/proxmox-api-go/proxmox"
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
 )
 
 type providerConfiguration struct {
 	Client          *pxapi.Client
+	Api             *apiClient
 	MaxParallel     int
 	CurrentParallel int
 	MaxVMID         int
+	VmIdRangeStart  int
+	VmIdRangeEnd    int
+	NodeSsh         *nodeSshConfig
 	Mutex           *sync.Mutex
 	Cond            *sync.Cond
 }
@@ -26,17 +33,43 @@ func Provider() *schema.Provider {
 		Schema: map[string]*schema.Schema{
 			"api_username": {
 				Type:        schema.TypeString,
-				Required:    true,
+				Optional:    true,
 				DefaultFunc: schema.EnvDefaultFunc("PROXMOX_USER", nil),
 				Description: "username, maywith with @pam",
 			},
 			"api_password": {
 				Type:        schema.TypeString,
-				Required:    true,
+				Optional:    true,
 				DefaultFunc: schema.EnvDefaultFunc("PROMOX_PASS", nil),
 				Description: "secret",
 				Sensitive:   true,
 			},
+			"api_token_id": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("PM_API_TOKEN_ID", nil),
+				Description: "API token id, as user@realm!tokenname",
+			},
+			"api_token_secret": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("PM_API_TOKEN_SECRET", nil),
+				Description: "API token secret (uuid)",
+				Sensitive:   true,
+			},
+			"api_otp": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("PM_OTP", nil),
+				Description: "TOTP code, for realms with two-factor authentication",
+				Sensitive:   true,
+			},
+			"api_ticket_file": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("PM_TICKET_FILE", nil),
+				Description: "file caching the login ticket, so that it is reused across runs",
+			},
 			"api_url": {
 				Type:        schema.TypeString,
 				Required:    true,
@@ -48,6 +81,18 @@ func Provider() *schema.Provider {
 				Optional: true,
 				Default:  false,
 			},
+			"api_ca_cert": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("PM_CA_CERT", nil),
+				Description: "PEM CA bundle, or path to it, used to verify the API certificate",
+			},
+			"api_tls_fingerprint": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("PM_TLS_FINGERPRINT", nil),
+				Description: "SHA-256 fingerprint of the API certificate, as shown by `pvenode cert info`",
+			},
 			"api_parallel_clones": {
 				Type:     schema.TypeBool,
 				Optional: true,
@@ -64,13 +109,62 @@ func Provider() *schema.Provider {
 				Optional: true,
 				Default:  4,
 			},
+			"vmid_range_start": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ValidateFunc: validation.IntAtLeast(100),
+				Description:  "first vmid allocated to new VMs and containers",
+			},
+			"vmid_range_end": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ValidateFunc: validation.IntAtLeast(100),
+				Description:  "last vmid allocated to new VMs and containers",
+			},
+			"node_ssh_username": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("PM_NODE_SSH_USER", "root"),
+				Description: "SSH user on the nodes, used to write cloud-init snippets",
+			},
+			"node_ssh_password": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("PM_NODE_SSH_PASSWORD", nil),
+				Sensitive:   true,
+			},
+			"node_ssh_private_key": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("PM_NODE_SSH_PRIVATE_KEY", nil),
+				Description: "PEM private key, or path to it",
+				Sensitive:   true,
+			},
+			"node_ssh_port": {
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  22,
+			},
+			"node_ssh_host_key": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "host public keys of the nodes, one per line in authorized_keys format, ~/.ssh/known_hosts is used if not set",
+			},
+			"node_ssh_insecure": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "do not verify the host keys of the nodes",
+			},
 		},
 
 		ResourcesMap: map[string]*schema.Resource{
-			"proxmox_vm_qemu": resourceVmQemu(),
-			// TODO - storage_iso
-			// TODO - bridge
-			// TODO - vm_qemu_template
+			"proxmox_vm_qemu":           resourceVmQemu(),
+			"proxmox_lxc":               resourceLxc(),
+			"proxmox_vm_qemu_template":  resourceVmQemuTemplate(),
+			"proxmox_storage_iso":       resourceStorageIso(),
+			"proxmox_network_bridge":    resourceNetworkBridge(),
+			"proxmox_cloudinit_snippet": resourceCloudInitSnippet(),
 		},
 
 		ConfigureFunc: providerConfigure,
@@ -78,47 +172,264 @@ func Provider() *schema.Provider {
 }
 
 func providerConfigure(d *schema.ResourceData) (configuration interface{}, err error) {
-	client, err := pxapi.NewClient(&pxapi.Configuration{
+	err = validateCredentials(
+		d.Get("api_username").(string),
+		d.Get("api_password").(string),
+		d.Get("api_token_id").(string),
+		d.Get("api_token_secret").(string),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := apiTlsConfig(
+		d.Get("api_url").(string),
+		d.Get("api_tls_insecure").(bool),
+		d.Get("api_ca_cert").(string),
+		d.Get("api_tls_fingerprint").(string),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	pxConfig := &pxapi.Configuration{
 		Url:			d.Get("api_url").(string),	
 		Username:		d.Get("api_username").(string),
 		Password:		d.Get("api_password").(string),
-		TlsInsecure:	d.Get("api_tls_insecure").(bool),
+		TokenId:		d.Get("api_token_id").(string),
+		TokenSecret:	d.Get("api_token_secret").(string),
+		TlsConfig:		tlsConfig,
 		ParallelClone:	d.Get("api_parallel_clones").(bool),
 		ParallelResize:	d.Get("api_parallel_resizes").(bool),
-		}, true)
+		}
 
+	vmIdRangeStart := d.Get("vmid_range_start").(int)
+	vmIdRangeEnd := d.Get("vmid_range_end").(int)
+	if (vmIdRangeStart == 0) != (vmIdRangeEnd == 0) {
+		return nil, fmt.Errorf("vmid_range_start and vmid_range_end must be set together")
+	}
+	if vmIdRangeEnd < vmIdRangeStart {
+		return nil, fmt.Errorf("vmid_range_end (%d) is lower than vmid_range_start (%d)", vmIdRangeEnd, vmIdRangeStart)
+	}
+
+	client, api, err := connectApi(
+		pxConfig,
+		d.Get("api_otp").(string),
+		d.Get("api_ticket_file").(string),
+	)
 	if err != nil {
 		return nil, err
 	}
+	nodeSsh := &nodeSshConfig{
+		Username:   d.Get("node_ssh_username").(string),
+		Password:   d.Get("node_ssh_password").(string),
+		PrivateKey: d.Get("node_ssh_private_key").(string),
+		HostKey:    d.Get("node_ssh_host_key").(string),
+		Insecure:   d.Get("node_ssh_insecure").(bool),
+		Port:       d.Get("node_ssh_port").(int),
+	}
 	var mut sync.Mutex
 	return &providerConfiguration{
 		Client:          client,
+		Api:             api,
 		MaxParallel:     d.Get("parallel_resources").(int),
 		CurrentParallel: 0,
 		MaxVMID:         -1,
+		VmIdRangeStart:  vmIdRangeStart,
+		VmIdRangeEnd:    vmIdRangeEnd,
+		NodeSsh:         nodeSsh,
 		Mutex:           &mut,
 		Cond:            sync.NewCond(&mut),
 	}, nil
 }
 
+var rxTokenId = regexp.MustCompile("^[^@!]+@[^@!]+![A-Za-z][A-Za-z0-9._-]*$")
+
+// Password and API token authentication are mutually exclusive, and each of
+// them needs both of its arguments.
+func validateCredentials(username string, password string, tokenId string, tokenSecret string) error {
+	passwordAuth := username != "" || password != ""
+	tokenAuth := tokenId != "" || tokenSecret != ""
+	switch {
+	case passwordAuth && tokenAuth:
+		return fmt.Errorf("api_username/api_password and api_token_id/api_token_secret are mutually exclusive")
+	case tokenAuth:
+		if tokenId == "" || tokenSecret == "" {
+			return fmt.Errorf("Both api_token_id and api_token_secret are required for API token authentication")
+		}
+		if !rxTokenId.MatchString(tokenId) {
+			return fmt.Errorf("Invalid api_token_id: %s, expected user@realm!tokenname", tokenId)
+		}
+	case passwordAuth:
+		if username == "" || password == "" {
+			return fmt.Errorf("Both api_username and api_password are required for password authentication")
+		}
+	default:
+		return fmt.Errorf("Either api_username/api_password or api_token_id/api_token_secret must be set")
+	}
+	return nil
+}
+
 func nextVmId(pconf *providerConfiguration) (nextId int, err error) {
 	pconf.Mutex.Lock()
-	pconf.MaxVMID, err = pconf.Client.GetNextID(pconf.MaxVMID + 1)
+	defer pconf.Mutex.Unlock()
+	if pconf.VmIdRangeStart == 0 {
+		pconf.MaxVMID, err = pconf.Client.GetNextID(pconf.MaxVMID + 1)
+		if err != nil {
+			return 0, err
+		}
+		return pconf.MaxVMID, nil
+	}
+
+	usedIds, err := usedVmIds(pconf.Api)
 	if err != nil {
 		return 0, err
 	}
-	nextId = pconf.MaxVMID
-	pconf.Mutex.Unlock()
-	return nextId, nil
+	nextId = pconf.VmIdRangeStart
+	if pconf.MaxVMID >= nextId {
+		nextId = pconf.MaxVMID + 1
+	}
+	for ; nextId <= pconf.VmIdRangeEnd; nextId++ {
+		if !usedIds[nextId] {
+			pconf.MaxVMID = nextId
+			return nextId, nil
+		}
+	}
+	return 0, fmt.Errorf("No free vmid left in range %d-%d", pconf.VmIdRangeStart, pconf.VmIdRangeEnd)
 }
 
-func pmParallelBegin(pconf *providerConfiguration) {
+// Collect the ids used by VMs and containers, and by volumes left on storages
+// by VMs that do not exist anymore: reusing their id would adopt them.
+func usedVmIds(api *apiClient) (map[int]bool, error) {
+	usedIds := map[int]bool{}
+
+	data, err := api.get("/cluster/resources", map[string]interface{}{"type": "vm"})
+	if err != nil {
+		return nil, err
+	}
+	vms, _ := data.([]interface{})
+	for _, vm := range vms {
+		vmMap, _ := vm.(map[string]interface{})
+		if vmId, isInt := deviceValue2Schema(vmMap["vmid"], schema.TypeInt).(int); isInt {
+			usedIds[vmId] = true
+		}
+	}
+
+	data, err = api.get("/cluster/resources", map[string]interface{}{"type": "storage"})
+	if err != nil {
+		return nil, err
+	}
+	storages, _ := data.([]interface{})
+	sharedDone := map[string]bool{}
+	for _, storage := range storages {
+		storageMap, _ := storage.(map[string]interface{})
+		storageName := fmt.Sprint(storageMap["storage"])
+		if shared := fmt.Sprint(storageMap["shared"]); shared == "1" {
+			if sharedDone[storageName] {
+				continue
+			}
+			sharedDone[storageName] = true
+		}
+		if storageMap["status"] != "available" {
+			continue
+		}
+		data, err = api.get(fmt.Sprintf("/nodes/%s/storage/%s/content", storageMap["node"], storageName), nil)
+		if err != nil {
+			log.Printf("[DEBUG] cannot list volumes of %s on %s: %v", storageName, storageMap["node"], err)
+			continue
+		}
+		volumes, _ := data.([]interface{})
+		for _, volume := range volumes {
+			volumeMap, _ := volume.(map[string]interface{})
+			if vmId, isInt := deviceValue2Schema(volumeMap["vmid"], schema.TypeInt).(int); isInt {
+				usedIds[vmId] = true
+			}
+		}
+	}
+	return usedIds, nil
+}
+
+// Number of ids tried when a create conflicts with another process.
+const vmIdAttempts = 10
+
+// Create a VM or container with requestedId, or the next free id if 0.
+// Proxmox atomically refuses to create a configuration over an existing id,
+// which makes the create itself the cluster-wide reservation: when another
+// process took the allocated id first, the create is retried with the next one.
+func createWithVmId(
+	pconf *providerConfiguration,
+	requestedId int,
+	resType string,
+	targetNode string,
+	create func(vmr *pxapi.VmRef) error,
+) (*pxapi.VmRef, error) {
+
+	for attempt := 1; ; attempt++ {
+		vmId := requestedId
+		if vmId == 0 {
+			log.Print("[DEBUG] get next VmId")
+			var err error
+			vmId, err = nextVmId(pconf)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		vmr := pxapi.NewVmRef(vmId)
+		vmr.SetNode(targetNode)
+		vmr.SetVmType(resType)
+		err := create(vmr)
+		if err == nil {
+			return vmr, nil
+		}
+		if _, conflict := err.(*vmIdConflictError); !conflict {
+			return nil, err
+		}
+		if requestedId != 0 {
+			return nil, fmt.Errorf("vmid %d is already used by another VM or container", vmId)
+		}
+		if attempt == vmIdAttempts {
+			return nil, fmt.Errorf("No free vmid found after %d attempts: %v", attempt, err)
+		}
+		log.Printf("[DEBUG] vmid %d taken concurrently, trying the next one", vmId)
+	}
+}
+
+// Refusal of a create request because its id is taken, as opposed to a
+// failure of the task it started.
+type vmIdConflictError struct {
+	err error
+}
+
+func (e *vmIdConflictError) Error() string {
+	return e.err.Error()
+}
+
+func isVmIdConflict(err error, vmId int) bool {
+	return regexp.MustCompile(fmt.Sprintf("\\b(VM|CT) %d already exists", vmId)).MatchString(err.Error())
+}
+
+func pmParallelBegin(pconf *providerConfiguration, dl deadline) error {
+	// wake up waiters when the deadline is reached
+	timer := time.AfterFunc(time.Until(dl.time), func() {
+		pconf.Mutex.Lock()
+		pconf.Cond.Broadcast()
+		pconf.Mutex.Unlock()
+	})
+	defer timer.Stop()
+
 	pconf.Mutex.Lock()
+	defer pconf.Mutex.Unlock()
 	for pconf.CurrentParallel >= pconf.MaxParallel {
+		if dl.expired() {
+			// pass on a slot that may have been signaled to us
+			pconf.Cond.Signal()
+			return dl.errorf("waiting for one of the %d parallel_resources slots", pconf.MaxParallel)
+		}
 		pconf.Cond.Wait()
 	}
 	pconf.CurrentParallel++
-	pconf.Mutex.Unlock()
+	return nil
 }
 
 func pmParallelEnd(pconf *providerConfiguration) {
@@ -132,12 +443,13 @@ func resourceId(targetNode string, resType string, vmId int) string {
 	return fmt.Sprintf("%s/%s/%d", targetNode, resType, vmId)
 }
 
-var rxRsId = regexp.MustCompile("([^/]+)/([^/]+)/(\\d+)")
+var rxRsId = regexp.MustCompile("^([^/]+)/([^/]+)/(\\d+)$")
 
 func parseResourceId(resId string) (targetNode string, resType string, vmId int, err error) {
 	idMatch := rxRsId.FindStringSubmatch(resId)
 	if idMatch == nil {
 		err = fmt.Errorf("Invalid resource id: %s", resId)
+		return
 	}
 	targetNode = idMatch[1]
 	resType = idMatch[2]
@@ -0,0 +1,36 @@
+package proxmox
+
+import "testing"
+
+func TestValidateCredentials(t *testing.T) {
+	cases := []struct {
+		name        string
+		username    string
+		password    string
+		tokenId     string
+		tokenSecret string
+		valid       bool
+	}{
+		{"password", "root@pam", "secret", "", "", true},
+		{"token", "", "", "terraform@pve!provider", "5f8a-uuid", true},
+		{"token with dots", "", "", "ci.bot@pve!tf_1.2", "5f8a-uuid", true},
+		{"nothing", "", "", "", "", false},
+		{"username only", "root@pam", "", "", "", false},
+		{"password only", "", "secret", "", "", false},
+		{"token id only", "", "", "terraform@pve!provider", "", false},
+		{"token secret only", "", "", "", "5f8a-uuid", false},
+		{"both", "root@pam", "secret", "terraform@pve!provider", "5f8a-uuid", false},
+		{"token without name", "", "", "terraform@pve", "5f8a-uuid", false},
+		{"token without realm", "", "", "terraform!provider", "5f8a-uuid", false},
+	}
+
+	for _, c := range cases {
+		err := validateCredentials(c.username, c.password, c.tokenId, c.tokenSecret)
+		if c.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
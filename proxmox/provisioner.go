@@ -3,7 +3,6 @@ package proxmox
 import (
 	"context"
 	"fmt"
-	"time"
 
 	pxapi "github.com/enix/proxmox-api-go/proxmox"
 	"github.com/hashicorp/terraform/helper/schema"
@@ -29,6 +28,7 @@ func Provisioner() terraform.ResourceProvisioner {
 }
 
 var currentClient *pxapi.Client
+var currentApi *apiClient
 
 func applyFn(ctx context.Context) error {
 	data := ctx.Value(schema.ProvConfigDataKey).(*schema.ResourceData)
@@ -43,19 +43,41 @@ func applyFn(ctx context.Context) error {
 	}
 	vmr := pxapi.NewVmRef(vmID)
 	vmr.SetNode(targetNode)
-	client := currentClient
+	vmr.SetVmType(vmType)
+	client, api := currentClient, currentApi
 	if client == nil {
-		client, err := pxapi.NewClient(&pxapi.Configuration{
+		err = validateCredentials(
+			connInfo["api_username"],
+			connInfo["api_password"],
+			connInfo["api_token_id"],
+			connInfo["api_token_secret"],
+		)
+		if err != nil {
+			return err
+		}
+		tlsConfig, err := apiTlsConfig(
+			connInfo["api_url"],
+			connInfo["api_tls_insecure"] == "true",
+			connInfo["api_ca_cert"],
+			connInfo["api_tls_fingerprint"],
+		)
+		if err != nil {
+			return err
+		}
+		client, api, err = connectApi(&pxapi.Configuration{
 			Url:			connInfo["api_url"],	
 			Username:		connInfo["api_username"],
 			Password:		connInfo["api_password"],
-			TlsInsecure:	connInfo["api_tls_insecure"] == "true",
-			}, true)
+			TokenId:		connInfo["api_token_id"],
+			TokenSecret:	connInfo["api_token_secret"],
+			TlsConfig:		tlsConfig,
+			}, connInfo["api_otp"], connInfo["api_ticket_file"])
 		if err != nil {
 			return err
 		}
-		currentClient = client
+		currentClient, currentApi = client, api
 	}
+	dl := newDeadline(act, defaultTaskTimeout)
 	switch act {
 	case "sshbackward":
 		return pxapi.RemoveSshForwardUsernet(vmr, client)
@@ -65,13 +87,14 @@ func applyFn(ctx context.Context) error {
 		if err != nil {
 			return err
 		}
-		time.Sleep(10 * time.Second)
+		err = waitForVmUnlock(api, vmr, dl)
+		if err != nil {
+			return err
+		}
 		vmParams := map[string]interface{}{
 			"net1": data.Get("net1").(string),
 		}
-		_, err = client.SetVmConfig(vmr, vmParams)
-		time.Sleep(10 * time.Second)
-		return err
+		return setQemuConfig(api, vmr, vmParams, dl)
 	default:
 		return fmt.Errorf("Unkown action: %s", act)
 	}
@@ -0,0 +1,239 @@
+package proxmox
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+// Length of the content hash suffixed to snippet names.
+const snippetHashLength = 12
+
+func resourceCloudInitSnippet() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceCloudInitSnippetCreate,
+		Read:   resourceCloudInitSnippetRead,
+		Update: resourceCloudInitSnippetUpdate,
+		Delete: resourceCloudInitSnippetDelete,
+		Importer: &schema.ResourceImporter{
+			State: resourceCloudInitSnippetImport,
+		},
+
+		// A new content is written to a new file: let the VMs that use the
+		// volume id know that it changes.
+		CustomizeDiff: func(d *schema.ResourceDiff, meta interface{}) error {
+			if d.Id() != "" && d.HasChange("content") {
+				for _, arg := range []string{"volume_id", "content_hash"} {
+					if err := d.SetNewComputed(arg); err != nil {
+						return err
+					}
+				}
+				return d.SetNewComputed("versions")
+			}
+			return nil
+		},
+
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(5 * time.Minute),
+			Update: schema.DefaultTimeout(5 * time.Minute),
+			Delete: schema.DefaultTimeout(5 * time.Minute),
+		},
+
+		Schema: map[string]*schema.Schema{
+			"target_node": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "Node the snippet is written from, any node for a shared storage",
+			},
+			"storage": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"name": {
+				Type:         schema.TypeString,
+				Required:     true,
+				ForceNew:     true,
+				ValidateFunc: validation.StringMatch(regexp.MustCompile("^[A-Za-z0-9][A-Za-z0-9._-]*$"), "must be a file name"),
+				Description:  "Prefix of the snippet file, completed with the hash of its content",
+			},
+			"content": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"content_hash": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"volume_id": {
+				Type:        schema.TypeString,
+				Computed:    true,
+				Description: "Volume id of the current version, as used by cicustom",
+			},
+			"versions": {
+				Type:        schema.TypeList,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Volume ids of the versions written, deleted along with the resource",
+			},
+		},
+	}
+}
+
+// Every content gets its own file, so that a change produces a new volume id
+// and VMs still using the previous version are not modified under them.
+func snippetFilename(name string, content string) (filename string, contentHash string) {
+	sum := sha256.Sum256([]byte(content))
+	contentHash = hex.EncodeToString(sum[:])
+	return fmt.Sprintf("%s-%s.yaml", name, contentHash[:snippetHashLength]), contentHash
+}
+
+func resourceCloudInitSnippetCreate(d *schema.ResourceData, meta interface{}) (err error) {
+	pconf := meta.(*providerConfiguration)
+	dl := resourceDeadline(d, schema.TimeoutCreate)
+	err = pmParallelBegin(pconf, dl)
+	if err != nil {
+		return err
+	}
+	defer pmParallelEnd(pconf)
+
+	err = writeSnippetVersion(d, pconf, dl)
+	if err != nil {
+		return err
+	}
+	return resourceCloudInitSnippetReadVolume(d, pconf.Api)
+}
+
+// Previous versions are kept until the resource is destroyed.
+func resourceCloudInitSnippetUpdate(d *schema.ResourceData, meta interface{}) (err error) {
+	pconf := meta.(*providerConfiguration)
+	dl := resourceDeadline(d, schema.TimeoutUpdate)
+	err = pmParallelBegin(pconf, dl)
+	if err != nil {
+		return err
+	}
+	defer pmParallelEnd(pconf)
+
+	if d.HasChange("content") {
+		err = writeSnippetVersion(d, pconf, dl)
+		if err != nil {
+			return err
+		}
+	}
+	return resourceCloudInitSnippetReadVolume(d, pconf.Api)
+}
+
+func writeSnippetVersion(d *schema.ResourceData, pconf *providerConfiguration, dl deadline) error {
+	content := d.Get("content").(string)
+	filename, contentHash := snippetFilename(d.Get("name").(string), content)
+	volumeId, err := writeSnippet(pconf, d.Get("target_node").(string), d.Get("storage").(string), filename, content, dl)
+	if err != nil {
+		return err
+	}
+	d.SetId(volumeId)
+	d.Set("content_hash", contentHash)
+	// the new versions are unknown in the plan, add to the previous ones
+	oldVersions, _ := d.GetChange("versions")
+	versions := oldVersions.([]interface{})
+	for _, version := range versions {
+		if version == volumeId {
+			return nil
+		}
+	}
+	d.Set("versions", append(versions, volumeId))
+	return nil
+}
+
+func resourceCloudInitSnippetRead(d *schema.ResourceData, meta interface{}) (err error) {
+	pconf := meta.(*providerConfiguration)
+	err = pmParallelBegin(pconf, resourceDeadline(d, schema.TimeoutRead))
+	if err != nil {
+		return err
+	}
+	defer pmParallelEnd(pconf)
+	return resourceCloudInitSnippetReadVolume(d, pconf.Api)
+}
+
+func resourceCloudInitSnippetReadVolume(d *schema.ResourceData, api *apiClient) error {
+	snippets, err := listSnippets(api, d.Get("target_node").(string), d.Get("storage").(string))
+	if err != nil {
+		return err
+	}
+	if !snippets[d.Id()] {
+		log.Printf("[WARN] snippet %s not found, removing from state", d.Id())
+		d.SetId("")
+		return nil
+	}
+	d.Set("volume_id", d.Id())
+	return nil
+}
+
+var rxSnippetImportId = regexp.MustCompile(fmt.Sprintf("^([^/]+)/(([^:/]+):snippets/(([A-Za-z0-9][A-Za-z0-9._-]*)-[0-9a-f]{%d}\\.yaml))$", snippetHashLength))
+
+// Snippets are imported with `<node>/<volume id>`, and their content read
+// back from the node.
+func resourceCloudInitSnippetImport(d *schema.ResourceData, meta interface{}) ([]*schema.ResourceData, error) {
+	pconf := meta.(*providerConfiguration)
+	match := rxSnippetImportId.FindStringSubmatch(d.Id())
+	if match == nil {
+		return nil, fmt.Errorf("Invalid import id: %s, expected <node>/<storage>:snippets/<name>-<hash>.yaml", d.Id())
+	}
+	node, volumeId, storage, filename, name := match[1], match[2], match[3], match[4], match[5]
+	content, err := readSnippet(pconf, node, storage, filename, resourceDeadline(d, schema.TimeoutRead))
+	if err != nil {
+		return nil, err
+	}
+	_, contentHash := snippetFilename(name, content)
+
+	d.SetId(volumeId)
+	d.Set("target_node", node)
+	d.Set("storage", storage)
+	d.Set("name", name)
+	d.Set("content", content)
+	d.Set("content_hash", contentHash)
+	d.Set("versions", []string{volumeId})
+	err = resourceCloudInitSnippetRead(d, meta)
+	if err != nil {
+		return nil, err
+	}
+	if d.Id() == "" {
+		return nil, fmt.Errorf("Snippet %s not found on %s", volumeId, node)
+	}
+	return []*schema.ResourceData{d}, nil
+}
+
+func resourceCloudInitSnippetDelete(d *schema.ResourceData, meta interface{}) (err error) {
+	pconf := meta.(*providerConfiguration)
+	err = pmParallelBegin(pconf, resourceDeadline(d, schema.TimeoutDelete))
+	if err != nil {
+		return err
+	}
+	defer pmParallelEnd(pconf)
+	api := pconf.Api
+
+	// only the versions written by this resource: other files may share
+	// its name and hash pattern
+	node := d.Get("target_node").(string)
+	snippets, err := listSnippets(api, node, d.Get("storage").(string))
+	if err != nil {
+		return err
+	}
+	for _, version := range d.Get("versions").([]interface{}) {
+		volumeId := version.(string)
+		if !snippets[volumeId] {
+			continue
+		}
+		err = deleteSnippet(api, node, volumeId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
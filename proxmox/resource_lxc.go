@@ -0,0 +1,558 @@
+package proxmox
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	pxapi "github.com/enix/proxmox-api-go/proxmox"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+const lxcType = "lxc"
+
+func resourceLxc() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceLxcCreate,
+		Read:   resourceLxcRead,
+		Update: resourceLxcUpdate,
+		Delete: resourceLxcDelete,
+		Exists: resourceLxcExists,
+		Importer: &schema.ResourceImporter{
+			State: resourceLxcImport,
+		},
+
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(20 * time.Minute),
+			Update: schema.DefaultTimeout(20 * time.Minute),
+			Delete: schema.DefaultTimeout(10 * time.Minute),
+		},
+
+		Schema: map[string]*schema.Schema{
+			"target_node": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"ostemplate": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				ForceNew:         true,
+				DiffSuppressFunc: suppressCreationOnlyDiff("ostemplate"),
+				Description:      "Template volume, e.g. local:vztmpl/debian-9.0-standard_9.7-1_amd64.tar.gz",
+			},
+			"hostname": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Computed: true,
+			},
+			"desc": {
+				Type:     schema.TypeString,
+				Optional: true,
+				DiffSuppressFunc: func(k, old, new string, d *schema.ResourceData) bool {
+					return strings.TrimSpace(old) == strings.TrimSpace(new)
+				},
+			},
+			"onboot": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+			"cores": {
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  1,
+			},
+			"memory": {
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  512,
+			},
+			"swap": {
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  512,
+			},
+			"unprivileged": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+				ForceNew: true,
+			},
+			"password": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				Sensitive:        true,
+				ForceNew:         true,
+				DiffSuppressFunc: suppressCreationOnlyDiff("ostemplate"),
+			},
+			"ssh_public_keys": {
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: true,
+				DiffSuppressFunc: func(k, old, new string, d *schema.ResourceData) bool {
+					return strings.TrimSpace(old) == strings.TrimSpace(new) || suppressCreationOnlyDiff("ostemplate")(k, old, new, d)
+				},
+			},
+			"features": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"nesting": &schema.Schema{
+							Type:     schema.TypeBool,
+							Optional: true,
+							Default:  false,
+						},
+						"keyctl": &schema.Schema{
+							Type:     schema.TypeBool,
+							Optional: true,
+							Default:  false,
+						},
+					},
+				},
+			},
+			"rootfs": &schema.Schema{
+				Type:     schema.TypeList,
+				Required: true,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"storage": &schema.Schema{
+							Type:     schema.TypeString,
+							Required: true,
+							ForceNew: true,
+						},
+						"size": &schema.Schema{
+							Type:     schema.TypeString,
+							Required: true,
+						},
+						"volume": &schema.Schema{
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+					},
+				},
+			},
+			"mountpoint": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"mp": &schema.Schema{
+							Type:        schema.TypeString,
+							Required:    true,
+							ForceNew:    true,
+							Description: "Path of the mountpoint in the container.",
+						},
+						"storage": &schema.Schema{
+							Type:     schema.TypeString,
+							Required: true,
+							ForceNew: true,
+						},
+						"size": &schema.Schema{
+							Type:     schema.TypeString,
+							Required: true,
+						},
+						"backup": &schema.Schema{
+							Type:     schema.TypeBool,
+							Optional: true,
+							Default:  false,
+						},
+						"volume": &schema.Schema{
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+					},
+				},
+			},
+			"network": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"name": &schema.Schema{
+							Type:        schema.TypeString,
+							Required:    true,
+							Description: "Interface name in the container, e.g. eth0.",
+						},
+						"bridge": &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+							Default:  "vmbr0",
+						},
+						"ip": &schema.Schema{
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "IPv4 address in CIDR format, dhcp or manual.",
+						},
+						"gw": &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+						"ip6": &schema.Schema{
+							Type:        schema.TypeString,
+							Optional:    true,
+							Description: "IPv6 address in CIDR format, auto, dhcp or manual.",
+						},
+						"gw6": &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+						"hwaddr": &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+							Computed: true,
+						},
+						"tag": &schema.Schema{
+							Type:        schema.TypeInt,
+							Optional:    true,
+							Description: "VLAN tag.",
+							Default:     -1,
+						},
+						"firewall": &schema.Schema{
+							Type:     schema.TypeBool,
+							Optional: true,
+							Default:  false,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func resourceLxcCreate(d *schema.ResourceData, meta interface{}) (err error) {
+	pconf := meta.(*providerConfiguration)
+	dl := resourceDeadline(d, schema.TimeoutCreate)
+	err = pmParallelBegin(pconf, dl)
+	if err != nil {
+		return err
+	}
+	defer pmParallelEnd(pconf)
+	api := pconf.Api
+
+	ostemplate := d.Get("ostemplate").(string)
+	if ostemplate == "" {
+		return fmt.Errorf("ostemplate is required to create a container")
+	}
+
+	params, err := state2ConfigLxc(d)
+	if err != nil {
+		return err
+	}
+	params["ostemplate"] = ostemplate
+	params["unprivileged"] = d.Get("unprivileged").(bool)
+	if password := d.Get("password").(string); password != "" {
+		params["password"] = password
+	}
+	if sshKeys := d.Get("ssh_public_keys").(string); sshKeys != "" {
+		params["ssh-public-keys"] = sshKeys
+	}
+
+	rootfs := d.Get("rootfs").([]interface{})[0].(map[string]interface{})
+	rootfsSize, err := sizeGB(rootfs["size"].(string))
+	if err != nil {
+		return err
+	}
+	params["rootfs"] = fmt.Sprintf("%s:%v", rootfs["storage"], rootfsSize)
+	for mpID, mp := range d.Get("mountpoint").([]interface{}) {
+		params[fmt.Sprintf("mp%d", mpID)], err = lxcNewMountpoint(mp.(map[string]interface{}))
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Print("[DEBUG] creating container")
+	vmr, err := createWithVmId(pconf, 0, lxcType, d.Get("target_node").(string), func(vmr *pxapi.VmRef) error {
+		params["vmid"] = vmr.VmId()
+		return runCreateTask(api, "POST", fmt.Sprintf("/nodes/%s/%s", vmr.Node(), lxcType), params, vmr, dl)
+	})
+	if err != nil {
+		return err
+	}
+	d.SetId(strconv.Itoa(vmr.VmId()))
+
+	log.Print("[DEBUG] starting container")
+	err = startVm(api, vmr, dl)
+	if err != nil {
+		return err
+	}
+	return resourceLxcReadVmr(d, api, vmr)
+}
+
+func resourceLxcUpdate(d *schema.ResourceData, meta interface{}) (err error) {
+	pconf := meta.(*providerConfiguration)
+	dl := resourceDeadline(d, schema.TimeoutUpdate)
+	err = pmParallelBegin(pconf, dl)
+	if err != nil {
+		return err
+	}
+	defer pmParallelEnd(pconf)
+	api := pconf.Api
+	vmr := lxcVmRef(d)
+
+	params, err := state2ConfigLxc(d)
+	if err != nil {
+		return err
+	}
+	data, err := api.get(vmPath(vmr)+"/config", nil)
+	if err != nil {
+		return err
+	}
+	currentConfig, _ := data.(map[string]interface{})
+
+	// Mountpoints: existing volumes keep their id and the options the schema
+	// does not cover, such as size, new ones are allocated.
+	oldMps, newMps := d.GetChange("mountpoint")
+	for mpID, mp := range newMps.([]interface{}) {
+		mpMap := mp.(map[string]interface{})
+		key := fmt.Sprintf("mp%d", mpID)
+		volume, _ := mpMap["volume"].(string)
+		if current, ok := currentConfig[key].(string); ok && volume != "" {
+			params[key] = mergeDeviceOptions(current, mpMap, "mp", "backup")
+		} else if volume != "" {
+			params[key] = deviceString(volume, mpMap, "mp", "backup")
+		} else {
+			params[key], err = lxcNewMountpoint(mpMap)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Only send what changed.
+	values := params2Values(params)
+	for key := range params {
+		if current, ok := currentConfig[key]; ok && values.Get(key) == fmt.Sprint(current) {
+			delete(params, key)
+		}
+	}
+	deletes := []string{}
+	for mpID := len(newMps.([]interface{})); mpID < len(oldMps.([]interface{})); mpID++ {
+		deletes = append(deletes, fmt.Sprintf("mp%d", mpID))
+	}
+	oldNets, newNets := d.GetChange("network")
+	for netID := len(newNets.([]interface{})); netID < len(oldNets.([]interface{})); netID++ {
+		deletes = append(deletes, fmt.Sprintf("net%d", netID))
+	}
+	if len(d.Get("features").([]interface{})) == 0 {
+		deletes = append(deletes, "features")
+	}
+	if d.Get("desc").(string) == "" {
+		deletes = append(deletes, "description")
+	}
+	keptDeletes := []string{}
+	for _, key := range deletes {
+		if _, ok := currentConfig[key]; ok {
+			keptDeletes = append(keptDeletes, key)
+		}
+	}
+	if len(keptDeletes) > 0 {
+		params["delete"] = strings.Join(keptDeletes, ",")
+	}
+	if len(params) > 0 {
+		_, err = api.put(vmPath(vmr)+"/config", params)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Volumes can only grow.
+	if d.HasChange("rootfs.0.size") {
+		err = resizeVmVolume(api, vmr, "rootfs", d.Get("rootfs.0.size").(string), dl)
+		if err != nil {
+			return err
+		}
+	}
+	for mpID, mp := range oldMps.([]interface{}) {
+		key := fmt.Sprintf("mountpoint.%d.size", mpID)
+		if mpID < len(newMps.([]interface{})) && mp.(map[string]interface{})["volume"] != "" && d.HasChange(key) {
+			err = resizeVmVolume(api, vmr, fmt.Sprintf("mp%d", mpID), d.Get(key).(string), dl)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return resourceLxcReadVmr(d, api, vmr)
+}
+
+func resourceLxcRead(d *schema.ResourceData, meta interface{}) (err error) {
+	pconf := meta.(*providerConfiguration)
+	dl := resourceDeadline(d, schema.TimeoutRead)
+	err = pmParallelBegin(pconf, dl)
+	if err != nil {
+		return err
+	}
+	defer pmParallelEnd(pconf)
+	return resourceLxcReadVmr(d, pconf.Api, lxcVmRef(d))
+}
+
+func resourceLxcReadVmr(d *schema.ResourceData, api *apiClient, vmr *pxapi.VmRef) error {
+	data, err := api.get(vmPath(vmr)+"/config", nil)
+	if err != nil {
+		return err
+	}
+	config, _ := data.(map[string]interface{})
+
+	d.SetId(strconv.Itoa(vmr.VmId()))
+	d.Set("target_node", vmr.Node())
+	d.Set("hostname", config["hostname"])
+	if description, ok := config["description"].(string); ok {
+		d.Set("desc", description)
+	} else {
+		d.Set("desc", "")
+	}
+	d.Set("onboot", deviceValue2Schema(configValue(config, "onboot", 0), schema.TypeBool))
+	d.Set("cores", deviceValue2Schema(configValue(config, "cores", 1), schema.TypeInt))
+	d.Set("memory", deviceValue2Schema(configValue(config, "memory", 512), schema.TypeInt))
+	d.Set("swap", deviceValue2Schema(configValue(config, "swap", 512), schema.TypeInt))
+	d.Set("unprivileged", deviceValue2Schema(configValue(config, "unprivileged", 0), schema.TypeBool))
+
+	lxcSchema := resourceLxc().Schema
+	if features, ok := config["features"].(string); ok {
+		d.Set("features", qemuDevices2List(
+			pxapi.QemuDevices{0: parseDevice(features, "")},
+			deviceSchema(lxcSchema["features"]),
+		))
+	} else {
+		d.Set("features", nil)
+	}
+
+	rootfs := pxapi.QemuDevices{}
+	if rootfsConf, ok := config["rootfs"].(string); ok {
+		rootfs[0] = parseDevice(rootfsConf, "volume")
+	}
+	d.Set("rootfs", qemuDevices2List(rootfs, deviceSchema(lxcSchema["rootfs"])))
+
+	// Disks.
+	configMpsList := d.Get("mountpoint").([]interface{})
+	activeMps := lxcDevices(config, "mp", "volume")
+	d.Set("mountpoint", updateDevicesList(configMpsList, activeMps, deviceSchema(lxcSchema["mountpoint"])))
+	// Networks.
+	configNetworksList := d.Get("network").([]interface{})
+	activeNetworks := lxcDevices(config, "net", "")
+	d.Set("network", updateDevicesList(configNetworksList, activeNetworks, deviceSchema(lxcSchema["network"])))
+
+	return nil
+}
+
+func resourceLxcImport(d *schema.ResourceData, meta interface{}) ([]*schema.ResourceData, error) {
+	pconf := meta.(*providerConfiguration)
+
+	vmr, err := importVmRef(pconf.Client, d.Id(), lxcType)
+	if err != nil {
+		return nil, err
+	}
+	d.SetId(strconv.Itoa(vmr.VmId()))
+	d.Set("target_node", vmr.Node())
+	err = resourceLxcRead(d, meta)
+	if err != nil {
+		return nil, err
+	}
+	return []*schema.ResourceData{d}, nil
+}
+
+func resourceLxcDelete(d *schema.ResourceData, meta interface{}) (err error) {
+	pconf := meta.(*providerConfiguration)
+	dl := resourceDeadline(d, schema.TimeoutDelete)
+	err = pmParallelBegin(pconf, dl)
+	if err != nil {
+		return err
+	}
+	defer pmParallelEnd(pconf)
+	api := pconf.Api
+	vmr := lxcVmRef(d)
+	data, err := api.get(vmPath(vmr)+"/status/current", nil)
+	if err != nil {
+		return err
+	}
+	if vmState, _ := data.(map[string]interface{}); vmState["status"] == "running" {
+		err = stopVm(api, vmr, dl)
+		if err != nil {
+			return err
+		}
+	}
+	return deleteVm(api, vmr, false, dl)
+}
+
+func resourceLxcExists(d *schema.ResourceData, meta interface{}) (exists bool, err error) {
+	pconf := meta.(*providerConfiguration)
+	err = pmParallelBegin(pconf, resourceDeadline(d, schema.TimeoutRead))
+	if err != nil {
+		return false, err
+	}
+	defer pmParallelEnd(pconf)
+
+	_, err = pconf.Api.get(vmPath(lxcVmRef(d))+"/status/current", nil)
+	if err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+func lxcVmRef(d *schema.ResourceData) *pxapi.VmRef {
+	vmId, _ := strconv.Atoi(d.Id())
+	vmr := pxapi.NewVmRef(vmId)
+	vmr.SetNode(d.Get("target_node").(string))
+	vmr.SetVmType(lxcType)
+	return vmr
+}
+
+// Settings that can be changed on an existing container. Volumes are handled
+// separately as they are allocated on creation only.
+func state2ConfigLxc(d *schema.ResourceData) (map[string]interface{}, error) {
+	params := map[string]interface{}{
+		"cores":  d.Get("cores").(int),
+		"memory": d.Get("memory").(int),
+		"swap":   d.Get("swap").(int),
+		"onboot": d.Get("onboot").(bool),
+	}
+	if hostname := d.Get("hostname").(string); hostname != "" {
+		params["hostname"] = hostname
+	}
+	if description := d.Get("desc").(string); description != "" {
+		params["description"] = description
+	}
+	if features := d.Get("features").([]interface{}); len(features) > 0 {
+		params["features"] = deviceString("", features[0].(map[string]interface{}), "nesting", "keyctl")
+	}
+	for netID, network := range d.Get("network").([]interface{}) {
+		params[fmt.Sprintf("net%d", netID)] = deviceString(
+			"", network.(map[string]interface{}),
+			"name", "bridge", "hwaddr", "ip", "gw", "ip6", "gw6", "tag", "firewall",
+		)
+	}
+	return params, nil
+}
+
+// A new mountpoint volume is allocated with `<storage>:<size in GB>`.
+func lxcNewMountpoint(mp map[string]interface{}) (string, error) {
+	size, err := sizeGB(mp["size"].(string))
+	if err != nil {
+		return "", err
+	}
+	return deviceString(fmt.Sprintf("%s:%v", mp["storage"], size), mp, "mp", "backup"), nil
+}
+
+var rxLxcDeviceName = regexp.MustCompile("^(mp|net)(\\d+)$")
+
+// Collect mpN or netN entries of a container configuration by id.
+func lxcDevices(config map[string]interface{}, prefix string, volumeKey string) pxapi.QemuDevices {
+	devices := pxapi.QemuDevices{}
+	for key, value := range config {
+		match := rxLxcDeviceName.FindStringSubmatch(key)
+		if match == nil || match[1] != prefix {
+			continue
+		}
+		deviceID, _ := strconv.Atoi(match[2])
+		devices[deviceID] = parseDevice(fmt.Sprint(value), volumeKey)
+	}
+	return devices
+}
+
@@ -0,0 +1,341 @@
+package proxmox
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+func resourceNetworkBridge() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceNetworkBridgeCreate,
+		Read:   resourceNetworkBridgeRead,
+		Update: resourceNetworkBridgeUpdate,
+		Delete: resourceNetworkBridgeDelete,
+		Importer: &schema.ResourceImporter{
+			State: resourceNetworkBridgeImport,
+		},
+
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(5 * time.Minute),
+			Update: schema.DefaultTimeout(5 * time.Minute),
+			Delete: schema.DefaultTimeout(5 * time.Minute),
+		},
+
+		Schema: map[string]*schema.Schema{
+			"target_node": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"name": {
+				Type:        schema.TypeString,
+				Required:    true,
+				ForceNew:    true,
+				Description: "Interface name, e.g. vmbr1, bond0 or vmbr0.100",
+			},
+			"type": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				Default:      "bridge",
+				ValidateFunc: validation.StringInSlice([]string{"bridge", "bond", "vlan"}, false),
+			},
+			"autostart": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+			"cidr": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"gateway": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"cidr6": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"gateway6": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"mtu": {
+				Type:     schema.TypeInt,
+				Optional: true,
+			},
+			"comments": {
+				Type:     schema.TypeString,
+				Optional: true,
+				DiffSuppressFunc: func(k, old, new string, d *schema.ResourceData) bool {
+					return strings.TrimSpace(old) == strings.TrimSpace(new)
+				},
+			},
+			"bridge_ports": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem:     &schema.Schema{Type: schema.TypeString},
+			},
+			"bridge_vlan_aware": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"slaves": {
+				Type:        schema.TypeList,
+				Optional:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Interfaces aggregated by a bond.",
+			},
+			"bond_mode": {
+				Type:     schema.TypeString,
+				Optional: true,
+				ValidateFunc: validation.StringInSlice([]string{
+					"balance-rr", "active-backup", "balance-xor", "broadcast",
+					"802.3ad", "balance-tlb", "balance-alb",
+				}, false),
+			},
+			"bond_xmit_hash_policy": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validation.StringInSlice([]string{"layer2", "layer2+3", "layer3+4"}, false),
+			},
+			"vlan_raw_device": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Underlying interface of a VLAN interface named vlan<id>.",
+			},
+			"vlan_id": {
+				Type:     schema.TypeInt,
+				Optional: true,
+			},
+			"apply": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     true,
+				Description: "Reload the node network configuration after each change.",
+			},
+		},
+	}
+}
+
+// Arguments that are sent as is, and read back under the same name.
+var networkStringArgs = map[string]string{
+	"cidr":                  "cidr",
+	"gateway":               "gateway",
+	"cidr6":                 "cidr6",
+	"gateway6":              "gateway6",
+	"comments":              "comments",
+	"bond_mode":             "bond_mode",
+	"bond_xmit_hash_policy": "bond_xmit_hash_policy",
+	"vlan_raw_device":       "vlan-raw-device",
+}
+
+// Arguments holding a space separated list of interfaces.
+var networkListArgs = map[string]string{
+	"bridge_ports": "bridge_ports",
+	"slaves":       "slaves",
+}
+
+func resourceNetworkBridgeCreate(d *schema.ResourceData, meta interface{}) (err error) {
+	pconf := meta.(*providerConfiguration)
+	dl := resourceDeadline(d, schema.TimeoutCreate)
+	err = pmParallelBegin(pconf, dl)
+	if err != nil {
+		return err
+	}
+	defer pmParallelEnd(pconf)
+	api := pconf.Api
+
+	node := d.Get("target_node").(string)
+	name := d.Get("name").(string)
+	params, _ := state2ConfigNetwork(d)
+	params["iface"] = name
+
+	log.Printf("[DEBUG] creating network interface %s on %s", name, node)
+	_, err = api.post(fmt.Sprintf("/nodes/%s/network", node), params)
+	if err != nil {
+		return err
+	}
+	d.SetId(fmt.Sprintf("%s/%s", node, name))
+
+	err = applyNetworkConfig(d, api, dl)
+	if err != nil {
+		return err
+	}
+	return resourceNetworkBridgeReadIface(d, api)
+}
+
+func resourceNetworkBridgeUpdate(d *schema.ResourceData, meta interface{}) (err error) {
+	pconf := meta.(*providerConfiguration)
+	dl := resourceDeadline(d, schema.TimeoutUpdate)
+	err = pmParallelBegin(pconf, dl)
+	if err != nil {
+		return err
+	}
+	defer pmParallelEnd(pconf)
+	api := pconf.Api
+
+	params, deletes := state2ConfigNetwork(d)
+	if len(deletes) > 0 {
+		params["delete"] = strings.Join(deletes, ",")
+	}
+	_, err = api.put(networkPath(d), params)
+	if err != nil {
+		return err
+	}
+
+	err = applyNetworkConfig(d, api, dl)
+	if err != nil {
+		return err
+	}
+	return resourceNetworkBridgeReadIface(d, api)
+}
+
+func resourceNetworkBridgeRead(d *schema.ResourceData, meta interface{}) (err error) {
+	pconf := meta.(*providerConfiguration)
+	err = pmParallelBegin(pconf, resourceDeadline(d, schema.TimeoutRead))
+	if err != nil {
+		return err
+	}
+	defer pmParallelEnd(pconf)
+	return resourceNetworkBridgeReadIface(d, pconf.Api)
+}
+
+func resourceNetworkBridgeReadIface(d *schema.ResourceData, api *apiClient) error {
+	node := d.Get("target_node").(string)
+	name := d.Get("name").(string)
+
+	// listed rather than read directly, to tell a removed interface apart
+	// from an API error
+	data, err := api.get(fmt.Sprintf("/nodes/%s/network", node), nil)
+	if err != nil {
+		return err
+	}
+	ifaces, _ := data.([]interface{})
+	var config map[string]interface{}
+	for _, iface := range ifaces {
+		ifaceMap, _ := iface.(map[string]interface{})
+		if ifaceMap["iface"] == name {
+			config = ifaceMap
+			break
+		}
+	}
+	if config == nil {
+		log.Printf("[WARN] network interface %s not found on %s, removing from state", name, node)
+		d.SetId("")
+		return nil
+	}
+
+	d.Set("type", config["type"])
+	d.Set("autostart", deviceValue2Schema(configValue(config, "autostart", 0), schema.TypeBool))
+	d.Set("bridge_vlan_aware", deviceValue2Schema(configValue(config, "bridge_vlan_aware", 0), schema.TypeBool))
+	d.Set("mtu", deviceValue2Schema(configValue(config, "mtu", 0), schema.TypeInt))
+	d.Set("vlan_id", deviceValue2Schema(configValue(config, "vlan-id", 0), schema.TypeInt))
+	for arg, apiKey := range networkStringArgs {
+		d.Set(arg, strings.TrimSpace(fmt.Sprint(configValue(config, apiKey, ""))))
+	}
+	for arg, apiKey := range networkListArgs {
+		d.Set(arg, strings.Fields(fmt.Sprint(configValue(config, apiKey, ""))))
+	}
+	return nil
+}
+
+// Import id is <node>/<interface>.
+func resourceNetworkBridgeImport(d *schema.ResourceData, meta interface{}) ([]*schema.ResourceData, error) {
+	parts := strings.SplitN(d.Id(), "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid import id: %s, expected <node>/<interface>", d.Id())
+	}
+	d.Set("target_node", parts[0])
+	d.Set("name", parts[1])
+	d.Set("apply", true)
+	err := resourceNetworkBridgeRead(d, meta)
+	if err != nil {
+		return nil, err
+	}
+	if d.Id() == "" {
+		return nil, fmt.Errorf("Network interface %s not found on %s", parts[1], parts[0])
+	}
+	return []*schema.ResourceData{d}, nil
+}
+
+func resourceNetworkBridgeDelete(d *schema.ResourceData, meta interface{}) (err error) {
+	pconf := meta.(*providerConfiguration)
+	dl := resourceDeadline(d, schema.TimeoutDelete)
+	err = pmParallelBegin(pconf, dl)
+	if err != nil {
+		return err
+	}
+	defer pmParallelEnd(pconf)
+	api := pconf.Api
+
+	_, err = api.delete(networkPath(d), nil)
+	if err != nil {
+		return err
+	}
+	return applyNetworkConfig(d, api, dl)
+}
+
+func networkPath(d *schema.ResourceData) string {
+	return fmt.Sprintf("/nodes/%s/network/%s", d.Get("target_node").(string), d.Get("name").(string))
+}
+
+// Build the interface parameters, along with the unset ones that have to be
+// removed from an existing interface.
+func state2ConfigNetwork(d *schema.ResourceData) (params map[string]interface{}, deletes []string) {
+	params = map[string]interface{}{
+		"type":      d.Get("type").(string),
+		"autostart": d.Get("autostart").(bool),
+	}
+	if d.Get("bridge_vlan_aware").(bool) {
+		params["bridge_vlan_aware"] = true
+	} else {
+		deletes = append(deletes, "bridge_vlan_aware")
+	}
+	if mtu := d.Get("mtu").(int); mtu > 0 {
+		params["mtu"] = mtu
+	} else {
+		deletes = append(deletes, "mtu")
+	}
+	if vlanId := d.Get("vlan_id").(int); vlanId > 0 {
+		params["vlan-id"] = vlanId
+	} else {
+		deletes = append(deletes, "vlan-id")
+	}
+	for arg, apiKey := range networkStringArgs {
+		if value := d.Get(arg).(string); value != "" {
+			params[apiKey] = value
+		} else {
+			deletes = append(deletes, apiKey)
+		}
+	}
+	for arg, apiKey := range networkListArgs {
+		items := []string{}
+		for _, item := range d.Get(arg).([]interface{}) {
+			items = append(items, item.(string))
+		}
+		if len(items) > 0 {
+			params[apiKey] = strings.Join(items, " ")
+		} else {
+			deletes = append(deletes, apiKey)
+		}
+	}
+	return params, deletes
+}
+
+// Pending changes live in /etc/network/interfaces.new until reloaded. Note
+// that the reload applies all pending changes of the node, not only ours.
+func applyNetworkConfig(d *schema.ResourceData, api *apiClient, dl deadline) error {
+	if !d.Get("apply").(bool) {
+		return nil
+	}
+	log.Printf("[DEBUG] reloading network configuration of %s", d.Get("target_node").(string))
+	return runTask(api, "PUT", fmt.Sprintf("/nodes/%s/network", d.Get("target_node").(string)), nil, dl)
+}
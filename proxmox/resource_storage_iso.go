@@ -0,0 +1,309 @@
+package proxmox
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+)
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha224": sha256.New224,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+func resourceStorageIso() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceStorageIsoCreate,
+		Read:   resourceStorageIsoRead,
+		Delete: resourceStorageIsoDelete,
+		Importer: &schema.ResourceImporter{
+			State: resourceStorageIsoImport,
+		},
+
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(60 * time.Minute),
+			Delete: schema.DefaultTimeout(10 * time.Minute),
+		},
+
+		Schema: map[string]*schema.Schema{
+			"target_node": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"storage": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"content": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				Default:      "iso",
+				ValidateFunc: validation.StringInSlice([]string{"iso", "vztmpl"}, false),
+			},
+			"source": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"url"},
+				Description:   "Local file to upload.",
+			},
+			"url": {
+				Type:          schema.TypeString,
+				Optional:      true,
+				ForceNew:      true,
+				ConflictsWith: []string{"source"},
+				Description:   "URL downloaded by the node.",
+			},
+			"verify_certificates": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				ForceNew: true,
+				Default:  true,
+			},
+			"filename": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Computed:    true,
+				ForceNew:    true,
+				Description: "Name of the file in the storage, defaults to the name of source or url.",
+			},
+			"checksum": {
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: true,
+				StateFunc: func(val interface{}) string {
+					return strings.ToLower(strings.TrimSpace(val.(string)))
+				},
+			},
+			"checksum_algorithm": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     true,
+				Default:      "sha256",
+				ValidateFunc: validation.StringInSlice([]string{"md5", "sha1", "sha224", "sha256", "sha384", "sha512"}, false),
+			},
+			"volume_id": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"size": {
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+		},
+	}
+}
+
+func resourceStorageIsoCreate(d *schema.ResourceData, meta interface{}) (err error) {
+	pconf := meta.(*providerConfiguration)
+	dl := resourceDeadline(d, schema.TimeoutCreate)
+	err = pmParallelBegin(pconf, dl)
+	if err != nil {
+		return err
+	}
+	defer pmParallelEnd(pconf)
+	api := pconf.Api
+
+	source := d.Get("source").(string)
+	sourceUrl := d.Get("url").(string)
+	if source == "" && sourceUrl == "" {
+		return fmt.Errorf("One of source or url is required")
+	}
+
+	filename := d.Get("filename").(string)
+	if filename == "" {
+		if source != "" {
+			filename = filepath.Base(source)
+		} else {
+			parsedUrl, err := url.Parse(sourceUrl)
+			if err != nil {
+				return err
+			}
+			filename = path.Base(parsedUrl.Path)
+		}
+	}
+
+	node := d.Get("target_node").(string)
+	storage := d.Get("storage").(string)
+	content := d.Get("content").(string)
+	storagePath := fmt.Sprintf("/nodes/%s/storage/%s", node, storage)
+	params := map[string]interface{}{
+		"content": content,
+	}
+	if checksum := d.Get("checksum").(string); checksum != "" {
+		params["checksum"] = strings.ToLower(strings.TrimSpace(checksum))
+		params["checksum-algorithm"] = d.Get("checksum_algorithm").(string)
+	}
+
+	var data interface{}
+	if source != "" {
+		// verified before sending, Proxmox checks it again on its side
+		if checksum, ok := params["checksum"]; ok {
+			err = verifyFileChecksum(source, d.Get("checksum_algorithm").(string), checksum.(string))
+			if err != nil {
+				return err
+			}
+		}
+		file, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		log.Printf("[DEBUG] uploading %s to %s", source, storage)
+		// the file part carries the name
+		data, err = api.upload(storagePath+"/upload", params, "filename", filename, file, dl)
+		if err != nil {
+			return err
+		}
+	} else {
+		params["url"] = sourceUrl
+		params["filename"] = filename
+		params["verify-certificates"] = d.Get("verify_certificates").(bool)
+		log.Printf("[DEBUG] downloading %s to %s", sourceUrl, storage)
+		data, err = api.post(storagePath+"/download-url", params)
+		if err != nil {
+			return err
+		}
+	}
+	if upid, isString := data.(string); isString && upid != "" {
+		err = waitForTask(api, upid, dl)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.SetId(fmt.Sprintf("%s:%s/%s", storage, content, filename))
+	d.Set("filename", filename)
+	return resourceStorageIsoReadVolume(d, api)
+}
+
+func resourceStorageIsoRead(d *schema.ResourceData, meta interface{}) (err error) {
+	pconf := meta.(*providerConfiguration)
+	err = pmParallelBegin(pconf, resourceDeadline(d, schema.TimeoutRead))
+	if err != nil {
+		return err
+	}
+	defer pmParallelEnd(pconf)
+	return resourceStorageIsoReadVolume(d, pconf.Api)
+}
+
+func resourceStorageIsoReadVolume(d *schema.ResourceData, api *apiClient) error {
+	volumeId := d.Id()
+	storage, content, filename, err := parseVolumeId(volumeId)
+	if err != nil {
+		return err
+	}
+
+	data, err := api.get(
+		fmt.Sprintf("/nodes/%s/storage/%s/content", d.Get("target_node").(string), storage),
+		map[string]interface{}{"content": content},
+	)
+	if err != nil {
+		return err
+	}
+	volumes, _ := data.([]interface{})
+	for _, volume := range volumes {
+		volumeMap, _ := volume.(map[string]interface{})
+		if volumeMap["volid"] != volumeId {
+			continue
+		}
+		d.Set("storage", storage)
+		d.Set("content", content)
+		d.Set("filename", filename)
+		d.Set("volume_id", volumeId)
+		d.Set("size", deviceValue2Schema(volumeMap["size"], schema.TypeInt))
+		return nil
+	}
+
+	log.Printf("[WARN] volume %s not found, removing from state", volumeId)
+	d.SetId("")
+	return nil
+}
+
+// Import id is <node>/<volume id>, e.g. pve1/local:iso/debian-9.iso
+func resourceStorageIsoImport(d *schema.ResourceData, meta interface{}) ([]*schema.ResourceData, error) {
+	parts := strings.SplitN(d.Id(), "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid import id: %s, expected <node>/<volume id>", d.Id())
+	}
+	d.SetId(parts[1])
+	d.Set("target_node", parts[0])
+	err := resourceStorageIsoRead(d, meta)
+	if err != nil {
+		return nil, err
+	}
+	if d.Id() == "" {
+		return nil, fmt.Errorf("Volume %s not found on %s", parts[1], parts[0])
+	}
+	return []*schema.ResourceData{d}, nil
+}
+
+func resourceStorageIsoDelete(d *schema.ResourceData, meta interface{}) (err error) {
+	pconf := meta.(*providerConfiguration)
+	dl := resourceDeadline(d, schema.TimeoutDelete)
+	err = pmParallelBegin(pconf, dl)
+	if err != nil {
+		return err
+	}
+	defer pmParallelEnd(pconf)
+
+	storage, _, _, err := parseVolumeId(d.Id())
+	if err != nil {
+		return err
+	}
+	volumePath := fmt.Sprintf("/nodes/%s/storage/%s/content/%s", d.Get("target_node").(string), storage, url.PathEscape(d.Id()))
+	return runTask(pconf.Api, "DELETE", volumePath, nil, dl)
+}
+
+// <storage>:<content>/<filename>
+func parseVolumeId(volumeId string) (storage string, content string, filename string, err error) {
+	storageVolume := strings.SplitN(volumeId, ":", 2)
+	if len(storageVolume) != 2 {
+		return "", "", "", fmt.Errorf("Invalid volume id: %s", volumeId)
+	}
+	contentFile := strings.SplitN(storageVolume[1], "/", 2)
+	if len(contentFile) != 2 {
+		return "", "", "", fmt.Errorf("Invalid volume id: %s", volumeId)
+	}
+	return storageVolume[0], contentFile[0], contentFile[1], nil
+}
+
+func verifyFileChecksum(filePath string, algorithm string, checksum string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hasher := checksumAlgorithms[algorithm]()
+	_, err = io.Copy(hasher, file)
+	if err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != checksum {
+		return fmt.Errorf("%s checksum mismatch for %s: got %s, expected %s", algorithm, filePath, sum, checksum)
+	}
+	return nil
+}
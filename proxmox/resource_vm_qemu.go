@@ -4,13 +4,17 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"net"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	pxapi "github.com/enix/proxmox-api-go/proxmox"
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
+	"golang.org/x/crypto/ssh"
 )
 
 const vmType = "qemu"
@@ -23,9 +27,26 @@ func resourceVmQemu() *schema.Resource {
 		Update: resourceVmQemuUpdate,
 		Delete: resourceVmQemuDelete,
 		Exists: resourceVmQemuExists,
-		// Importer: &schema.ResourceImporter{
-		// 	State: resourceVmQemuImport,
-		// },
+		Importer: &schema.ResourceImporter{
+			State: resourceVmQemuImport,
+		},
+
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(20 * time.Minute),
+			Update: schema.DefaultTimeout(20 * time.Minute),
+			Delete: schema.DefaultTimeout(10 * time.Minute),
+		},
+
+		CustomizeDiff: func(d *schema.ResourceDiff, meta interface{}) error {
+			err := validateIpConfigIndexes(d.Get("ipconfig").([]interface{}), len(d.Get("network").([]interface{})))
+			if err != nil {
+				return err
+			}
+			if d.Id() != "" && d.HasChange("target_node") && d.Get("recreate_on_node_change").(bool) {
+				return d.ForceNew("target_node")
+			}
+			return nil
+		},
 
 		Schema: map[string]*schema.Schema{
 			"name": {
@@ -41,9 +62,33 @@ func resourceVmQemu() *schema.Resource {
 				},
 			},
 			"target_node": {
-				Type:     schema.TypeString,
-				Required: true,
-				ForceNew: true,
+				Type:        schema.TypeString,
+				Required:    true,
+				Description: "Node hosting the VM, which is live migrated on change",
+			},
+			"migrate_with_local_disks": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"migrate_target_storage": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Storage of the local disks on the target node, the same one if not set",
+			},
+			"recreate_on_node_change": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Replace the VM instead of migrating it when target_node changes",
+			},
+			"vmid": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Computed:     true,
+				ForceNew:     true,
+				ValidateFunc: validation.IntAtLeast(100),
+				Description:  "VM id, the next free one if not set",
 			},
 			"onboot": {
 				Type:     schema.TypeBool,
@@ -51,14 +96,68 @@ func resourceVmQemu() *schema.Resource {
 				Default:  true,
 			},
 			"iso": {
-				Type:     schema.TypeString,
-				Optional: true,
-				ForceNew: true,
+				Type:             schema.TypeString,
+				Optional:         true,
+				ForceNew:         true,
+				DiffSuppressFunc: suppressCreationOnlyDiff("clone", "iso"),
 			},
 			"clone": {
-				Type:     schema.TypeString,
-				Optional: true,
-				ForceNew: true,
+				Type:             schema.TypeString,
+				Optional:         true,
+				ForceNew:         true,
+				DiffSuppressFunc: suppressCreationOnlyDiff("clone", "iso"),
+			},
+			"power_state": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "running",
+				ValidateFunc: validation.StringInSlice([]string{"running", "stopped", "paused"}, false),
+			},
+			"shutdown_timeout": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Default:     60,
+				Description: "Seconds to wait for an ACPI shutdown before stopping the VM",
+			},
+			"automatic_reboot": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Reboot the VM when a change could not be applied while it is running",
+			},
+			"pending_changes": {
+				Type:        schema.TypeMap,
+				Computed:    true,
+				Elem:        &schema.Schema{Type: schema.TypeString},
+				Description: "Settings applied at next boot, with their pending value, empty when pending removal",
+			},
+			"reboot_required": {
+				Type:     schema.TypeBool,
+				Computed: true,
+			},
+			"cloudinit_reboot": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Reboot the VM when its cloud-init configuration changes, for the guest to apply it",
+			},
+			"shutdown_before_delete": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "none",
+				ValidateFunc: validation.StringInSlice([]string{"none", "acpi", "agent"}, false),
+				Description:  "How to shut the guest down before deleting it, within shutdown_timeout, none being a hard stop",
+			},
+			"backup_before_delete": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Storage receiving a final vzdump backup of the VM before it is deleted",
+			},
+			"purge_on_delete": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     true,
+				Description: "Remove the VM from backup jobs, replication jobs and HA on delete",
 			},
 			"qemu_os": {
 				Type:     schema.TypeString,
@@ -87,9 +186,14 @@ func resourceVmQemu() *schema.Resource {
 							Required: true,
 						},
 						"macaddr": &schema.Schema{
-							// TODO: Find a way to set MAC address in .tf config.
-							Type:     schema.TypeString,
-							Computed: true,
+							Type:         schema.TypeString,
+							Optional:     true,
+							Computed:     true,
+							ValidateFunc: validateMacAddress,
+							DiffSuppressFunc: func(k, old, new string, d *schema.ResourceData) bool {
+								return strings.EqualFold(old, new)
+							},
+							Description: "Generated by Proxmox if not set, and kept across updates",
 						},
 						"bridge": &schema.Schema{
 							Type:     schema.TypeString,
@@ -205,27 +309,119 @@ func resourceVmQemu() *schema.Resource {
 				},
 			},
 			"cloudinit_searchdomain": {
-				Type:     schema.TypeString,
-				Optional: true,
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"search_domains"},
 			},
 			"cloudinit_nameserver": {
-				Type:     schema.TypeString,
-				Optional: true,
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"nameservers"},
 			},
 			"cloudinit_sshkeys": {
-				Type:     schema.TypeString,
-				Optional: true,
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"ssh_keys"},
 				DiffSuppressFunc: func(k, old, new string, d *schema.ResourceData) bool {
 					return strings.TrimSpace(old) == strings.TrimSpace(new)
 				},
 			},
+			"nameservers": {
+				Type:          schema.TypeList,
+				Optional:      true,
+				ConflictsWith: []string{"cloudinit_nameserver"},
+				Elem: &schema.Schema{
+					Type:         schema.TypeString,
+					ValidateFunc: validateIpAddress,
+				},
+			},
+			"search_domains": {
+				Type:          schema.TypeList,
+				Optional:      true,
+				ConflictsWith: []string{"cloudinit_searchdomain"},
+				Elem:          &schema.Schema{Type: schema.TypeString},
+			},
+			"ssh_keys": {
+				Type:          schema.TypeList,
+				Optional:      true,
+				ConflictsWith: []string{"cloudinit_sshkeys"},
+				Elem: &schema.Schema{
+					Type:         schema.TypeString,
+					ValidateFunc: validateSshPublicKey,
+				},
+				Description: "OpenSSH public keys of the cloud-init user",
+			},
 			"cloudinit_ipconfig0": {
-				Type:     schema.TypeString,
-				Optional: true,
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"ipconfig"},
 			},
 			"cloudinit_ipconfig1": {
-				Type:     schema.TypeString,
-				Optional: true,
+				Type:          schema.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"ipconfig"},
+			},
+			"cloudinit_user_data": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Snippet volume id (storage:snippets/file.yaml), or inline content written to cloudinit_snippets_storage",
+			},
+			"cloudinit_network_data": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Snippet volume id, or inline content",
+			},
+			"cloudinit_vendor_data": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Snippet volume id, or inline content",
+			},
+			"cloudinit_meta_data": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Snippet volume id, or inline content",
+			},
+			"cloudinit_snippets_storage": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "Storage with snippets content receiving inline cloud-init data",
+			},
+			"ipconfig": &schema.Schema{
+				Type:          schema.TypeList,
+				Optional:      true,
+				ConflictsWith: []string{"cloudinit_ipconfig0", "cloudinit_ipconfig1"},
+				Description:   "Cloud-init IP configuration of the network device of the same index",
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"index": &schema.Schema{
+							Type:         schema.TypeInt,
+							Required:     true,
+							ValidateFunc: validation.IntAtLeast(0),
+						},
+						"ipv4": &schema.Schema{
+							Type:         schema.TypeString,
+							Optional:     true,
+							ValidateFunc: validateIpConfigAddress("dhcp"),
+							Description:  "Address in CIDR notation, or dhcp",
+						},
+						"gateway": &schema.Schema{
+							Type:         schema.TypeString,
+							Optional:     true,
+							ValidateFunc: validateIpAddress,
+						},
+						"ipv6": &schema.Schema{
+							Type:         schema.TypeString,
+							Optional:     true,
+							ValidateFunc: validateIpConfigAddress("auto", "dhcp"),
+							Description:  "Address in CIDR notation, auto (SLAAC) or dhcp",
+						},
+						"gateway6": &schema.Schema{
+							Type:         schema.TypeString,
+							Optional:     true,
+							ValidateFunc: validateIpAddress,
+						},
+					},
+				},
 			},
 		},
 	}
@@ -235,9 +431,14 @@ var rxIPconfig = regexp.MustCompile("ip6?=([0-9a-fA-F:\\.]+)")
 
 func resourceVmQemuCreate(d *schema.ResourceData, meta interface{}) (err error) {
 	pconf := meta.(*providerConfiguration)
-	pmParallelBegin(pconf)
+	dl := resourceDeadline(d, schema.TimeoutCreate)
+	err = pmParallelBegin(pconf, dl)
+	if err != nil {
+		return err
+	}
 	defer pmParallelEnd(pconf)
 	client := pconf.Client
+	api := pconf.Api
 
 	// generate Proxmox configuration from Terraform configuration
 	config, err := state2ConfigQemu(d)
@@ -245,15 +446,8 @@ func resourceVmQemuCreate(d *schema.ResourceData, meta interface{}) (err error)
 		return err
 	}
 
-	log.Print("[DEBUG] get next VmId")
-	nextId, err := nextVmId(pconf)
-	if err != nil {
-		return err
-	}
-
-	vmr := pxapi.NewVmRef(nextId)
-	vmr.SetNode(d.Get("target_node").(string))
-	vmr.SetVmType(vmType)
+	var vmr *pxapi.VmRef
+	targetNode := d.Get("target_node").(string)
 
 	d.Partial(true)
 
@@ -264,121 +458,228 @@ func resourceVmQemuCreate(d *schema.ResourceData, meta interface{}) (err error)
 			return err
 		}
 		log.Print("[DEBUG] cloning VM")
-		err = config.CloneVm(sourceVmr, vmr, client)
+		vmr, err = createWithVmId(pconf, d.Get("vmid").(int), vmType, targetNode, func(vmr *pxapi.VmRef) error {
+			return cloneQemuVm(api, sourceVmr, vmr, config, dl)
+		})
 		if err != nil {
 			return err
 		}
 		d.SetId(strconv.Itoa(vmr.VmId()))
-		d.SetPartial("target_node")
-		d.SetPartial("name")
 		d.SetPartial("clone")
-
-		err = config.UpdateConfig(vmr, client)
-		if err != nil {
-			return err
-		}
-		d.SetPartial("network")
-		d.SetPartial("memory")
-		d.SetPartial("cloudinit_user")
-		d.SetPartial("cloudinit_password")
-		d.SetPartial("cloudinit_searchdomain")
-		d.SetPartial("cloudinit_nameserver")
-		d.SetPartial("cloudinit_sshkeys")
-		d.SetPartial("cloudinit_ipconfig0")
-		d.SetPartial("cloudinit_ipconfig1")
-
-		// give sometime to proxmox to catchup
-		time.Sleep(5 * time.Second)
-
-		err = prepareDiskSize(client, vmr, devicesList2QemuDevices(d.Get("disk").([]interface{})))
-		if err != nil {
-			return err
-		}
-		d.SetPartial("disk")
-	} else if d.Get("iso").(string) != "" {
-		config.QemuIso = d.Get("iso").(string)
-		err = config.CreateVm(vmr, client)
+	} else if iso := d.Get("iso").(string); iso != "" {
+		vmr, err = createWithVmId(pconf, d.Get("vmid").(int), vmType, targetNode, func(vmr *pxapi.VmRef) error {
+			params := map[string]interface{}{
+				"vmid": vmr.VmId(),
+				"name": config.Name,
+				"ide2": iso + ",media=cdrom",
+			}
+			return runCreateTask(api, "POST", fmt.Sprintf("/nodes/%s/%s", vmr.Node(), vmType), params, vmr, dl)
+		})
 		if err != nil {
 			return err
 		}
 		d.SetId(strconv.Itoa(vmr.VmId()))
-		d.SetPartial("target_node")
-		d.SetPartial("name")
+		d.SetPartial("iso")
+	} else {
+		return fmt.Errorf("One of clone or iso is required to create a VM")
+	}
+	d.SetPartial("target_node")
+	d.SetPartial("name")
+
+	err = waitForVmUnlock(api, vmr, dl)
+	if err != nil {
+		return err
+	}
+
+	// the rest of the configuration is set as on update, on top of what the
+	// clone or the creation gave, networks included so that they get their
+	// pinned MAC addresses
+	_, err = applyQemuConfigChanges(d, api, vmr, dl)
+	if err != nil {
+		return err
+	}
+	err = waitForVmUnlock(api, vmr, dl)
+	if err != nil {
+		return err
+	}
+	err = prepareDiskSize(client, api, vmr, devicesList2QemuDevices(d.Get("disk").([]interface{})), dl)
+	if err != nil {
+		return err
 	}
 	d.Partial(false)
 
-	// give sometime to proxmox to catchup
-	time.Sleep(5 * time.Second)
+	if hasCloudInitCustomChange(d) {
+		err = setCloudInitCustom(d, pconf, vmr, dl)
+		if err != nil {
+			return err
+		}
+	}
 
-	log.Print("[DEBUG] starting VM")
-	_, err = client.StartVm(vmr)
+	err = setPowerState(client, api, vmr, d.Get("power_state").(string), d.Get("shutdown_timeout").(int), dl)
 	if err != nil {
 		return err
 	}
-	return
+	return resourceVmQemuReadVmr(d, client, api, vmr)
 }
 
 func resourceVmQemuUpdate(d *schema.ResourceData, meta interface{}) (err error) {
 	pconf := meta.(*providerConfiguration)
-	pmParallelBegin(pconf)
-	defer pmParallelEnd(pconf)
-	client := pconf.Client
-
-	// generate Proxmox configuration from Terraform configuration
-	config, err := state2ConfigQemu(d)
+	dl := resourceDeadline(d, schema.TimeoutUpdate)
+	err = pmParallelBegin(pconf, dl)
 	if err != nil {
 		return err
 	}
+	defer pmParallelEnd(pconf)
+	client := pconf.Client
+	api := pconf.Api
 
 	vmId, _ := strconv.Atoi(d.Id())
 	vmr := pxapi.NewVmRef(vmId)
-	vmr.SetNode(d.Get("target_node").(string))
 	vmr.SetVmType(vmType)
 
-	err = config.UpdateConfig(vmr, client)
+	if d.HasChange("target_node") {
+		oldNode, newNode := d.GetChange("target_node")
+		vmr.SetNode(oldNode.(string))
+		log.Printf("[DEBUG] migrating VM from %s to %s", oldNode, newNode)
+		err = migrateVm(
+			api,
+			vmr,
+			newNode.(string),
+			d.Get("migrate_with_local_disks").(bool),
+			d.Get("migrate_target_storage").(string),
+			dl,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	vmr.SetNode(d.Get("target_node").(string))
+
+	cloudInitChanged := hasCloudInitChange(d)
+
+	currentConfig, err := applyQemuConfigChanges(d, api, vmr, dl)
 	if err != nil {
 		return err
 	}
+	if hasCloudInitCustomChange(d) {
+		err = setCloudInitCustom(d, pconf, vmr, dl)
+		if err != nil {
+			return err
+		}
+		deleteStaleCloudInitSnippets(d, api, vmr)
+	}
+	if cloudInitChanged && hasCloudInitDrive(currentConfig) {
+		log.Printf("[DEBUG] regenerating cloud-init drive of VM %d", vmId)
+		err = regenerateCloudInitDrive(api, vmr, dl)
+		if err != nil {
+			return err
+		}
+	}
 
-	// give sometime to proxmox to catchup
-	time.Sleep(5 * time.Second)
+	err = waitForVmUnlock(api, vmr, dl)
+	if err != nil {
+		return err
+	}
 
-	prepareDiskSize(client, vmr, devicesList2QemuDevices(d.Get("disk").([]interface{})))
+	err = prepareDiskSize(client, api, vmr, devicesList2QemuDevices(d.Get("disk").([]interface{})), dl)
+	if err != nil {
+		return err
+	}
 
-	// give sometime to proxmox to catchup
-	time.Sleep(5 * time.Second)
+	err = setPowerState(client, api, vmr, d.Get("power_state").(string), d.Get("shutdown_timeout").(int), dl)
+	if err != nil {
+		return err
+	}
+	err = applyPendingChanges(d, api, vmr, cloudInitChanged && d.Get("cloudinit_reboot").(bool), dl)
+	if err != nil {
+		return err
+	}
+	// pending_changes and reboot_required as left by this update
+	return resourceVmQemuReadVmr(d, client, api, vmr)
+}
 
-	// Start VM only if it wasn't running.
-	vmState, err := client.GetVmState(vmr)
+// Changes that could not be hotplugged are applied by a reboot with
+// automatic_reboot, and only reported otherwise. cloudInitReboot reboots the
+// VM anyway, for the guest to pick up its new cloud-init drive.
+func applyPendingChanges(d *schema.ResourceData, api *apiClient, vmr *pxapi.VmRef, cloudInitReboot bool, dl deadline) error {
+	if d.Get("power_state").(string) != "running" {
+		return nil
+	}
+	pending, err := qemuPendingChanges(api, vmr)
 	if err != nil {
 		return err
 	}
-	if vmState["status"] == "stopped" {
-		log.Print("[DEBUG] starting VM")
-		_, err = client.StartVm(vmr)
+	keys := make([]string, 0, len(pending))
+	for key := range pending {
+		keys = append(keys, key)
 	}
-	// give sometime to bootup
-	time.Sleep(9 * time.Second)
-	return
+	sort.Strings(keys)
+
+	switch {
+	case cloudInitReboot:
+		log.Printf("[DEBUG] rebooting VM %d to apply its cloud-init configuration", vmr.VmId())
+	case len(pending) == 0:
+		return nil
+	case d.Get("automatic_reboot").(bool):
+		log.Printf("[DEBUG] rebooting VM %d to apply changes to: %s", vmr.VmId(), strings.Join(keys, ", "))
+	default:
+		log.Printf("[WARN] VM %d must be rebooted to apply changes to: %s (see its pending_changes and reboot_required attributes)", vmr.VmId(), strings.Join(keys, ", "))
+		return nil
+	}
+	return rebootVm(api, vmr, d.Get("shutdown_timeout").(int), dl)
+}
+
+// Set the configuration of the arguments that changed, and return the
+// configuration the VM had before. Only what changed is sent, so that
+// settings that cannot be hotplugged are not left pending without reason.
+func applyQemuConfigChanges(d *schema.ResourceData, api *apiClient, vmr *pxapi.VmRef, dl deadline) (map[string]interface{}, error) {
+	data, err := api.get(vmPath(vmr)+"/config", nil)
+	if err != nil {
+		return nil, err
+	}
+	currentConfig, _ := data.(map[string]interface{})
+	params, deletes, err := qemuConfigChanges(d, currentConfig)
+	if err != nil {
+		return nil, err
+	}
+	if len(deletes) > 0 {
+		params["delete"] = strings.Join(deletes, ",")
+	}
+	if len(params) > 0 {
+		log.Printf("[DEBUG] updating VM %d configuration: %v", vmr.VmId(), params)
+		err = setQemuConfig(api, vmr, params, dl)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return currentConfig, nil
 }
 
 func resourceVmQemuRead(d *schema.ResourceData, meta interface{}) (err error) {
 	pconf := meta.(*providerConfiguration)
-	pmParallelBegin(pconf)
+	dl := resourceDeadline(d, schema.TimeoutRead)
+	err = pmParallelBegin(pconf, dl)
+	if err != nil {
+		return err
+	}
 	defer pmParallelEnd(pconf)
-	client := pconf.Client
 
 	vmId, _ := strconv.Atoi(d.Id())
 	vmr := pxapi.NewVmRef(vmId)
 	vmr.SetNode(d.Get("target_node").(string))
 	vmr.SetVmType(vmType)
+	return resourceVmQemuReadVmr(d, pconf.Client, pconf.Api, vmr)
+}
 
+func resourceVmQemuReadVmr(d *schema.ResourceData, client *pxapi.Client, api *apiClient, vmr *pxapi.VmRef) (err error) {
 	config, err := pxapi.NewConfigQemuFromApi(vmr, client)
 	if err != nil {
 		return err
 	}
 
+	vmId := vmr.VmId()
 	d.SetId(strconv.Itoa(vmId))
+	d.Set("vmid", vmId)
 	d.Set("target_node", vmr.Node())
 	d.Set("name", config.Name)
 	d.Set("desc", config.Description)
@@ -388,68 +689,274 @@ func resourceVmQemuRead(d *schema.ResourceData, meta interface{}) (err error) {
 	d.Set("sockets", config.QemuSockets)
 	d.Set("qemu_os", config.QemuOs)
 
+	vmState, err := client.GetVmState(vmr)
+	if err != nil {
+		return err
+	}
+	d.Set("power_state", powerState(vmState))
+
+	pending, err := qemuPendingChanges(api, vmr)
+	if err != nil {
+		return err
+	}
+	d.Set("pending_changes", pending)
+	d.Set("reboot_required", len(pending) > 0 && powerState(vmState) != "stopped")
+
 	if config.CIuser != "" {
 		d.Set("cloudinit_user", config.CIuser)
 	}
 	if config.CIpassword != "" {
 		d.Set("cloudinit_password", config.CIpassword)
 	}
-	if config.Searchdomain != "" {
-		d.Set("cloudinit_searchdomain", config.Searchdomain)
-	}
-	if config.Nameserver != "" {
-		d.Set("cloudinit_nameserver", config.Nameserver)
+	for arg, value := range qemuLegacyCloudInit(d, config) {
+		d.Set(arg, value)
 	}
-	if config.Sshkeys != "" {
-		d.Set("cloudinit_sshkeys", config.Sshkeys)
+
+	// settings that pxapi does not know about
+	data, err := api.get(vmPath(vmr)+"/config", nil)
+	if err != nil {
+		return err
 	}
-	if config.Ipconfig0 != "" {
-		d.Set("cloudinit_ipconfig0", config.Ipconfig0)
+	apiConfig, _ := data.(map[string]interface{})
+	if configIpconfigs := d.Get("ipconfig").([]interface{}); len(configIpconfigs) > 0 {
+		d.Set("ipconfig", updateIpconfigList(configIpconfigs, apiConfig))
 	}
-	if config.Ipconfig1 != "" {
-		d.Set("cloudinit_ipconfig1", config.Ipconfig1)
+	updateCloudInitCustom(d, apiConfig)
+	for arg, key := range qemuConfigListArgs {
+		if configItems := d.Get(arg).([]interface{}); len(configItems) > 0 {
+			d.Set(arg, updateConfigList(configItems, configList(apiConfig, key)))
+		}
 	}
 
-	// // Disks.
-	// configDisksSet := d.Get("disk").([]interface{})
-	// activeDisksSet := updateDevicesSet(configDisksSet, config.QemuDisks)
-	// d.Set("disk", activeDisksSet)
-	// d.Set("disk", configDisksSet)
+	// Disks.
+	completeDiskDefaults(config.QemuDisks)
+	configDisksList := d.Get("disk").([]interface{})
+	activeDisksList := updateDevicesList(configDisksList, config.QemuDisks, deviceSchema(resourceVmQemu().Schema["disk"]))
+	d.Set("disk", activeDisksList)
 	// Networks.
-	// configNetworksSet := d.Get("network").([]interface{})
-	// activeNetworksSet := updateDevicesSet(configNetworksSet, config.QemuNetworks)
-	// d.Set("network", activeNetworksSet)
-	// d.Set("network", configNetworksSet)
+	configNetworksList := d.Get("network").([]interface{})
+	activeNetworksList := updateDevicesList(configNetworksList, config.QemuNetworks, deviceSchema(resourceVmQemu().Schema["network"]))
+	d.Set("network", activeNetworksList)
 
 	return
 }
 
-// func resourceVmQemuImport(d *schema.ResourceData, meta interface{}) ([]*schema.ResourceData, error) {
-// 	// TODO: research proper import
-// 	err := resourceVmQemuRead(d, meta)
-// 	return []*schema.ResourceData{d}, err
-// }
+// Import accepts either a full resource id (<node>/qemu/<vmid>), a bare vmid
+// or a VM name, and resolves it to the node currently hosting the VM.
+func resourceVmQemuImport(d *schema.ResourceData, meta interface{}) ([]*schema.ResourceData, error) {
+	pconf := meta.(*providerConfiguration)
+	client := pconf.Client
+
+	vmr, err := importVmRef(client, d.Id(), vmType)
+	if err != nil {
+		return nil, err
+	}
+
+	d.SetId(strconv.Itoa(vmr.VmId()))
+	d.Set("target_node", vmr.Node())
+	// arguments that only drive the provider behaviour cannot be read back
+	for key, keySchema := range resourceVmQemu().Schema {
+		if keySchema.Default != nil {
+			d.Set(key, keySchema.Default)
+		}
+	}
+	err = resourceVmQemuRead(d, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read only refreshes the cloud-init lists and ipconfig blocks that are
+	// in use, which they are after import rather than their string forms.
+	data, err := pconf.Api.get(vmPath(vmr)+"/config", nil)
+	if err != nil {
+		return nil, err
+	}
+	apiConfig, _ := data.(map[string]interface{})
+	for arg, key := range qemuConfigListArgs {
+		d.Set(arg, configList(apiConfig, key))
+	}
+	d.Set("ipconfig", configIpconfigList(apiConfig))
+	for _, legacyArg := range []string{
+		"cloudinit_nameserver",
+		"cloudinit_searchdomain",
+		"cloudinit_sshkeys",
+		"cloudinit_ipconfig0",
+		"cloudinit_ipconfig1",
+	} {
+		d.Set(legacyArg, "")
+	}
+	return []*schema.ResourceData{d}, nil
+}
+
+// Find the VM referenced by an import id, whatever its form.
+func importVmRef(client *pxapi.Client, importId string, resType string) (vmr *pxapi.VmRef, err error) {
+	if rxRsId.MatchString(importId) {
+		targetNode, idType, vmId, err := parseResourceId(importId)
+		if err != nil {
+			return nil, err
+		}
+		if idType != resType {
+			return nil, fmt.Errorf("Invalid resource type %s in id %s, expected %s", idType, importId, resType)
+		}
+		vmr = pxapi.NewVmRef(vmId)
+		vmr.SetNode(targetNode)
+		vmr.SetVmType(resType)
+		_, err = client.GetVmState(vmr)
+		if err != nil {
+			return nil, err
+		}
+		return vmr, nil
+	}
+	if vmId, convErr := strconv.Atoi(importId); convErr == nil {
+		vmr = pxapi.NewVmRef(vmId)
+		err = client.CheckVmRef(vmr)
+	} else {
+		vmr, err = client.GetVmRefByName(importId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if vmr.GetVmType() != resType {
+		return nil, fmt.Errorf("VM %s is of type %s, expected %s", importId, vmr.GetVmType(), resType)
+	}
+	return vmr, nil
+}
+
+// A MAC address usable by a NIC, that is not a multicast one.
+func validateMacAddress(v interface{}, k string) (ws []string, errs []error) {
+	macaddr := v.(string)
+	hwAddr, err := net.ParseMAC(macaddr)
+	if err != nil || len(hwAddr) != 6 {
+		errs = append(errs, fmt.Errorf("%q must be a MAC address such as 52:54:00:12:34:56, got: %s", k, macaddr))
+	} else if hwAddr[0]&1 == 1 {
+		errs = append(errs, fmt.Errorf("%q must be a unicast MAC address, got: %s", k, macaddr))
+	}
+	return
+}
+
+func validateIpAddress(v interface{}, k string) (ws []string, errs []error) {
+	if net.ParseIP(v.(string)) == nil {
+		errs = append(errs, fmt.Errorf("%q must be an IP address, got: %s", k, v))
+	}
+	return
+}
+
+// An address in CIDR notation, or one of the given keywords.
+func validateIpConfigAddress(keywords ...string) schema.SchemaValidateFunc {
+	return func(v interface{}, k string) (ws []string, errs []error) {
+		address := v.(string)
+		for _, keyword := range keywords {
+			if address == keyword {
+				return
+			}
+		}
+		if _, _, err := net.ParseCIDR(address); err != nil {
+			errs = append(errs, fmt.Errorf("%q must be an address in CIDR notation or one of %v, got: %s", k, keywords, address))
+		}
+		return
+	}
+}
+
+// A single public key in authorized_keys format.
+func validateSshPublicKey(v interface{}, k string) (ws []string, errs []error) {
+	_, _, _, rest, err := ssh.ParseAuthorizedKey([]byte(v.(string)))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("%q must be an OpenSSH public key: %v", k, err))
+	} else if len(strings.TrimSpace(string(rest))) > 0 {
+		errs = append(errs, fmt.Errorf("%q must hold a single public key, one list item per key", k))
+	}
+	return
+}
+
+// Each ipconfig applies to an existing network device, at most once.
+func validateIpConfigIndexes(ipconfigs []interface{}, networkCount int) error {
+	seen := map[int]bool{}
+	for _, ipconfig := range ipconfigs {
+		index := ipconfig.(map[string]interface{})["index"].(int)
+		if index >= networkCount {
+			return fmt.Errorf("ipconfig index %d has no matching network, %d defined", index, networkCount)
+		}
+		if seen[index] {
+			return fmt.Errorf("ipconfig index %d is defined more than once", index)
+		}
+		seen[index] = true
+	}
+	return nil
+}
+
+// Creation-only arguments cannot be read back from Proxmox, so an imported
+// resource must not be replaced just because they appear in configuration.
+// A resource is imported when none of sourceArgs, the arguments it is created
+// from, is set in its state.
+func suppressCreationOnlyDiff(sourceArgs ...string) schema.SchemaDiffSuppressFunc {
+	return func(k, old, new string, d *schema.ResourceData) bool {
+		if old != "" || d.Id() == "" {
+			return false
+		}
+		for _, arg := range sourceArgs {
+			if oldValue, _ := d.GetChange(arg); oldValue != "" {
+				return false
+			}
+		}
+		return true
+	}
+}
 
 func resourceVmQemuDelete(d *schema.ResourceData, meta interface{}) (err error) {
 	pconf := meta.(*providerConfiguration)
-	pmParallelBegin(pconf)
+	dl := resourceDeadline(d, schema.TimeoutDelete)
+	err = pmParallelBegin(pconf, dl)
+	if err != nil {
+		return err
+	}
 	defer pmParallelEnd(pconf)
 	client := pconf.Client
+	api := pconf.Api
 	vmId, _ := strconv.Atoi(d.Id())
 	vmr := pxapi.NewVmRef(vmId)
-	_, err = client.StopVm(vmr)
+	vmr.SetNode(d.Get("target_node").(string))
+	vmr.SetVmType(vmType)
+
+	vmState, err := client.GetVmState(vmr)
 	if err != nil {
 		return err
 	}
-	// give sometime to proxmox to catchup
-	time.Sleep(2 * time.Second)
-	_, err = client.DeleteVm(vmr)
-	return
+	if powerState(vmState) != "stopped" {
+		shutdownTimeout := d.Get("shutdown_timeout").(int)
+		switch {
+		case d.Get("shutdown_before_delete").(string) == "acpi" && powerState(vmState) == "running":
+			err = shutdownVm(api, vmr, shutdownTimeout, dl)
+		case d.Get("shutdown_before_delete").(string) == "agent" && powerState(vmState) == "running":
+			err = agentShutdownVm(api, vmr, shutdownTimeout, dl)
+		default:
+			err = stopVm(api, vmr, dl)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if backupStorage := d.Get("backup_before_delete").(string); backupStorage != "" {
+		log.Printf("[DEBUG] backing up VM %d to %s", vmId, backupStorage)
+		err = backupVm(api, vmr, backupStorage, dl)
+		if err != nil {
+			return err
+		}
+	}
+	err = deleteVm(api, vmr, d.Get("purge_on_delete").(bool), dl)
+	if err != nil {
+		return err
+	}
+	deleteCloudInitSnippets(d, api, vmr)
+	return nil
 }
 
 func resourceVmQemuExists(d *schema.ResourceData, meta interface{}) (exists bool, err error) {
 	pconf := meta.(*providerConfiguration)
-	pmParallelBegin(pconf)
+	err = pmParallelBegin(pconf, resourceDeadline(d, schema.TimeoutRead))
+	if err != nil {
+		return false, err
+	}
 	defer pmParallelEnd(pconf)
 	client := pconf.Client
 	vmId, _ := strconv.Atoi(d.Id())
@@ -466,8 +973,10 @@ func resourceVmQemuExists(d *schema.ResourceData, meta interface{}) (exists bool
 // Increase disk size if original disk was smaller than new disk.
 func prepareDiskSize(
 	client *pxapi.Client,
+	api *apiClient,
 	vmr *pxapi.VmRef,
 	diskConfMap pxapi.QemuDevices,
+	dl deadline,
 ) error {
 	clonedConfig, err := pxapi.NewConfigQemuFromApi(vmr, client)
 	for diskID, diskConf := range diskConfMap {
@@ -491,7 +1000,7 @@ func prepareDiskSize(
 
 		diffSize := int(math.Ceil(diskSize - clonedDiskSize))
 		if diskSize > clonedDiskSize {
-			_, err := client.ResizeQemuDisk(vmr, diskName, diffSize)
+			err := resizeVmDisk(api, vmr, diskName, diffSize, dl)
 			if err != nil {
 				return err
 			}
@@ -500,70 +1009,37 @@ func prepareDiskSize(
 	return nil
 }
 
-// Update schema.TypeSet with new values comes from Proxmox API.
-// TODO: Maybe it's better to create a new Set instead add to current one.
-
-// func updateDevicesSet(
-// 	devicesSet *schema.Set,
-// 	devicesMap pxapi.QemuDevices,
-// ) *schema.Set {
-
-// 	configDevicesMap := devicesSetToMap(devicesSet)
-// 	activeDevicesMap := updateDevicesDefaults(devicesMap, configDevicesMap)
-
-// 	for _, setConf := range devicesSet.List() {
-// 		devicesSet.Remove(setConf)
-// 		setConfMap := setConf.(map[string]interface{})
-// 		deviceID := setConfMap["id"].(int)
-// 		// Value type should be one of types allowed by Terraform schema types.
-// 		for key, value := range activeDevicesMap[deviceID] {
-// 			// This nested switch is used for nested config like in `net[n]`,
-// 			// where Proxmox uses `key=<0|1>` in string" at the same time
-// 			// a boolean could be used in ".tf" files.
-// 			switch setConfMap[key].(type) {
-// 			case bool:
-// 				switch value.(type) {
-// 				// If the key is bool and value is int (which comes from Proxmox API),
-// 				// should be converted to bool (as in ".tf" conf).
-// 				case int:
-// 					sValue := strconv.Itoa(value.(int))
-// 					bValue, err := strconv.ParseBool(sValue)
-// 					if err == nil {
-// 						setConfMap[key] = bValue
-// 					}
-// 				// If value is bool, which comes from Terraform conf, add it directly.
-// 				case bool:
-// 					setConfMap[key] = value
-// 				}
-// 			// Anything else will be added as it is.
-// 			default:
-// 				setConfMap[key] = value
-// 			}
-// 			devicesSet.Add(setConfMap)
-// 		}
-// 	}
-
-// 	return devicesSet
-// }
+// Build the list of devices from values that come from Proxmox API.
+// Devices that only exist in Terraform configuration are left out, so that
+// removing a device outside of Terraform shows up as a diff.
+func updateDevicesList(
+	configDevicesList []interface{},
+	activeDevices pxapi.QemuDevices,
+	elemSchema map[string]*schema.Schema,
+) []interface{} {
+
+	configDevices := devicesList2QemuDevices(configDevicesList)
+	activeDevices = updateDevicesDefaults(activeDevices, configDevices)
+	return qemuDevices2List(activeDevices, elemSchema)
+}
 
 // Because default values are not stored in Proxmox, so the API returns only active values.
 // So to prevent Terraform doing unnecessary diffs, this function reads default values
 // from Terraform itself, and fill empty fields.
+func updateDevicesDefaults(
+	activeDevices pxapi.QemuDevices,
+	configDevices pxapi.QemuDevices,
+) pxapi.QemuDevices {
 
-// func updateDevicesDefaults(
-// 	activeDevicesMap pxapi.QemuDevices,
-// 	configDevicesMap pxapi.QemuDevices,
-// ) pxapi.QemuDevices {
-
-// 	for deviceID, deviceConf := range configDevicesMap {
-// 		if _, ok := activeDevicesMap[deviceID]; !ok {
-// 			activeDevicesMap[deviceID] = configDevicesMap[deviceID]
-// 		}
-// 		for key, value := range deviceConf {
-// 			if _, ok := activeDevicesMap[deviceID][key]; !ok {
-// 				activeDevicesMap[deviceID][key] = value
-// 			}
-// 		}
-// 	}
-// 	return activeDevicesMap
-// }
\ No newline at end of file
+	for deviceID, deviceConf := range configDevices {
+		if _, ok := activeDevices[deviceID]; !ok {
+			continue
+		}
+		for key, value := range deviceConf {
+			if _, ok := activeDevices[deviceID][key]; !ok {
+				activeDevices[deviceID][key] = value
+			}
+		}
+	}
+	return activeDevices
+}
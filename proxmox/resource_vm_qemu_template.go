@@ -0,0 +1,396 @@
+package proxmox
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	pxapi "github.com/enix/proxmox-api-go/proxmox"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// The cloud-init drive goes on ide0, leaving ide2 to the installation ISO.
+const templateCloudInitDrive = "ide0"
+
+func resourceVmQemuTemplate() *schema.Resource {
+	return &schema.Resource{
+		Create: resourceVmQemuTemplateCreate,
+		Read:   resourceVmQemuTemplateRead,
+		Delete: resourceVmQemuTemplateDelete,
+		Exists: resourceVmQemuTemplateExists,
+		Importer: &schema.ResourceImporter{
+			State: resourceVmQemuTemplateImport,
+		},
+
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(30 * time.Minute),
+			Delete: schema.DefaultTimeout(10 * time.Minute),
+		},
+
+		// A template is never modified in place: VMs cloned from it would not
+		// match its configuration anymore.
+		Schema: map[string]*schema.Schema{
+			"name": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"desc": {
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: true,
+				DiffSuppressFunc: func(k, old, new string, d *schema.ResourceData) bool {
+					return strings.TrimSpace(old) == strings.TrimSpace(new)
+				},
+			},
+			"target_node": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"iso": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				ForceNew:         true,
+				DiffSuppressFunc: suppressCreationOnlyDiff("iso", "cloud_image"),
+				ConflictsWith:    []string{"cloud_image"},
+				Description:      "ISO volume attached as cdrom, e.g. local:iso/ubuntu-18.04-server-amd64.iso",
+			},
+			"cloud_image": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				ForceNew:         true,
+				DiffSuppressFunc: suppressCreationOnlyDiff("iso", "cloud_image"),
+				ConflictsWith:    []string{"iso"},
+				Description:      "Disk image volume imported as the boot disk, e.g. local:iso/bionic-server-cloudimg-amd64.img",
+			},
+			"qemu_os": {
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: true,
+				Default:  "l26",
+			},
+			"memory": {
+				Type:     schema.TypeInt,
+				Required: true,
+				ForceNew: true,
+			},
+			"cores": {
+				Type:     schema.TypeInt,
+				Required: true,
+				ForceNew: true,
+			},
+			"sockets": {
+				Type:     schema.TypeInt,
+				Optional: true,
+				ForceNew: true,
+				Default:  1,
+			},
+			"agent": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				ForceNew: true,
+				Default:  false,
+			},
+			"serial_console": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				ForceNew:    true,
+				Default:     false,
+				Description: "Use a serial console, as most cloud images expect.",
+			},
+			"cloudinit_storage": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				ForceNew:    true,
+				Description: "Storage of the cloud-init drive, none if not set.",
+			},
+			"disk": &schema.Schema{
+				Type:     schema.TypeList,
+				Required: true,
+				ForceNew: true,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"type": &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+							ForceNew: true,
+							Default:  "scsi",
+						},
+						"storage": &schema.Schema{
+							Type:     schema.TypeString,
+							Required: true,
+							ForceNew: true,
+						},
+						"size": &schema.Schema{
+							Type:     schema.TypeString,
+							Required: true,
+							ForceNew: true,
+						},
+					},
+				},
+			},
+			"network": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				ForceNew: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"model": &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+							ForceNew: true,
+							Default:  "virtio",
+						},
+						"bridge": &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+							ForceNew: true,
+							Default:  "vmbr0",
+						},
+						"tag": &schema.Schema{
+							Type:        schema.TypeInt,
+							Optional:    true,
+							ForceNew:    true,
+							Description: "VLAN tag.",
+							Default:     -1,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func resourceVmQemuTemplateCreate(d *schema.ResourceData, meta interface{}) (err error) {
+	pconf := meta.(*providerConfiguration)
+	dl := resourceDeadline(d, schema.TimeoutCreate)
+	err = pmParallelBegin(pconf, dl)
+	if err != nil {
+		return err
+	}
+	defer pmParallelEnd(pconf)
+	api := pconf.Api
+
+	iso := d.Get("iso").(string)
+	cloudImage := d.Get("cloud_image").(string)
+	if iso == "" && cloudImage == "" {
+		return fmt.Errorf("One of iso or cloud_image is required to build a template")
+	}
+
+	params := map[string]interface{}{
+		"name":    d.Get("name").(string),
+		"ostype":  d.Get("qemu_os").(string),
+		"memory":  d.Get("memory").(int),
+		"cores":   d.Get("cores").(int),
+		"sockets": d.Get("sockets").(int),
+		"agent":   d.Get("agent").(bool),
+	}
+	if description := d.Get("desc").(string); description != "" {
+		params["description"] = description
+	}
+
+	disk := d.Get("disk").([]interface{})[0].(map[string]interface{})
+	diskName := fmt.Sprintf("%s0", disk["type"])
+	if cloudImage != "" {
+		// imported with its own size, grown below
+		params[diskName] = fmt.Sprintf("%s:0,import-from=%s", disk["storage"], cloudImage)
+	} else {
+		diskSize, err := sizeGB(disk["size"].(string))
+		if err != nil {
+			return err
+		}
+		params[diskName] = fmt.Sprintf("%s:%v", disk["storage"], diskSize)
+		params["ide2"] = iso + ",media=cdrom"
+	}
+	params["bootdisk"] = diskName
+
+	if cloudInitStorage := d.Get("cloudinit_storage").(string); cloudInitStorage != "" {
+		params[templateCloudInitDrive] = cloudInitStorage + ":cloudinit"
+	}
+	if d.Get("serial_console").(bool) {
+		params["serial0"] = "socket"
+		params["vga"] = "serial0"
+	}
+	for netID, network := range d.Get("network").([]interface{}) {
+		netMap := network.(map[string]interface{})
+		netConf := fmt.Sprintf("%s,bridge=%s", netMap["model"], netMap["bridge"])
+		if tag := netMap["tag"].(int); tag >= 0 {
+			netConf += fmt.Sprintf(",tag=%d", tag)
+		}
+		params[fmt.Sprintf("net%d", netID)] = netConf
+	}
+
+	log.Print("[DEBUG] creating template VM")
+	vmr, err := createWithVmId(pconf, 0, vmType, d.Get("target_node").(string), func(vmr *pxapi.VmRef) error {
+		params["vmid"] = vmr.VmId()
+		return runCreateTask(api, "POST", fmt.Sprintf("/nodes/%s/%s", vmr.Node(), vmType), params, vmr, dl)
+	})
+	if err != nil {
+		return err
+	}
+	d.SetId(strconv.Itoa(vmr.VmId()))
+
+	if cloudImage != "" {
+		err = resizeVmVolume(api, vmr, diskName, disk["size"].(string), dl)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Print("[DEBUG] converting VM to template")
+	err = runTask(api, "POST", vmPath(vmr)+"/template", nil, dl)
+	if err != nil {
+		return err
+	}
+	return resourceVmQemuTemplateReadVmr(d, api, vmr)
+}
+
+func resourceVmQemuTemplateRead(d *schema.ResourceData, meta interface{}) (err error) {
+	pconf := meta.(*providerConfiguration)
+	dl := resourceDeadline(d, schema.TimeoutRead)
+	err = pmParallelBegin(pconf, dl)
+	if err != nil {
+		return err
+	}
+	defer pmParallelEnd(pconf)
+	return resourceVmQemuTemplateReadVmr(d, pconf.Api, templateVmRef(d))
+}
+
+func resourceVmQemuTemplateReadVmr(d *schema.ResourceData, api *apiClient, vmr *pxapi.VmRef) error {
+	data, err := api.get(vmPath(vmr)+"/config", nil)
+	if err != nil {
+		return err
+	}
+	config, _ := data.(map[string]interface{})
+
+	if isTemplate, _ := deviceValue2Schema(configValue(config, "template", 0), schema.TypeBool).(bool); !isTemplate {
+		// converted back or replaced by a regular VM: recreate it
+		log.Printf("[WARN] VM %d is not a template anymore", vmr.VmId())
+		d.SetId("")
+		return nil
+	}
+
+	d.SetId(strconv.Itoa(vmr.VmId()))
+	d.Set("target_node", vmr.Node())
+	d.Set("name", config["name"])
+	if description, ok := config["description"].(string); ok {
+		d.Set("desc", description)
+	} else {
+		d.Set("desc", "")
+	}
+	d.Set("qemu_os", configValue(config, "ostype", "other"))
+	d.Set("memory", deviceValue2Schema(configValue(config, "memory", 512), schema.TypeInt))
+	d.Set("cores", deviceValue2Schema(configValue(config, "cores", 1), schema.TypeInt))
+	d.Set("sockets", deviceValue2Schema(configValue(config, "sockets", 1), schema.TypeInt))
+	d.Set("agent", strings.HasPrefix(fmt.Sprint(configValue(config, "agent", 0)), "1"))
+	d.Set("serial_console", config["vga"] == "serial0")
+
+	if cloudInitDrive, ok := config[templateCloudInitDrive].(string); ok && strings.Contains(cloudInitDrive, "cloudinit") {
+		d.Set("cloudinit_storage", strings.SplitN(cloudInitDrive, ":", 2)[0])
+	} else {
+		d.Set("cloudinit_storage", "")
+	}
+
+	bootdisk, ok := config["bootdisk"].(string)
+	if !ok {
+		bootdisk = "scsi0"
+	}
+	if diskConf, ok := config[bootdisk].(string); ok {
+		disk := parseDevice(diskConf, "volume")
+		size, _ := disk["size"].(string)
+		// keep the size as written when it is the same, such as 10G for 10240M
+		if disks := d.Get("disk").([]interface{}); len(disks) > 0 {
+			oldSize, _ := disks[0].(map[string]interface{})["size"].(string)
+			oldGB, oldErr := sizeGB(oldSize)
+			newGB, newErr := sizeGB(size)
+			if oldErr == nil && newErr == nil && oldGB == newGB {
+				size = oldSize
+			}
+		}
+		d.Set("disk", []interface{}{map[string]interface{}{
+			"type":    strings.TrimRight(bootdisk, "0123456789"),
+			"storage": disk["storage"],
+			"size":    size,
+		}})
+	} else {
+		d.Set("disk", nil)
+	}
+
+	// `<model>=<mac>,bridge=<bridge>[,tag=<tag>]`
+	networks := []interface{}{}
+	for netID := 0; ; netID++ {
+		netConf, ok := config[fmt.Sprintf("net%d", netID)].(string)
+		if !ok {
+			break
+		}
+		network := parseDevice(netConf, "")
+		tag := -1
+		if netTag, err := strconv.Atoi(fmt.Sprint(network["tag"])); err == nil {
+			tag = netTag
+		}
+		networks = append(networks, map[string]interface{}{
+			"model":  strings.SplitN(netConf, "=", 2)[0],
+			"bridge": network["bridge"],
+			"tag":    tag,
+		})
+	}
+	d.Set("network", networks)
+	return nil
+}
+
+func resourceVmQemuTemplateImport(d *schema.ResourceData, meta interface{}) ([]*schema.ResourceData, error) {
+	pconf := meta.(*providerConfiguration)
+
+	vmr, err := importVmRef(pconf.Client, d.Id(), vmType)
+	if err != nil {
+		return nil, err
+	}
+	d.SetId(strconv.Itoa(vmr.VmId()))
+	d.Set("target_node", vmr.Node())
+	err = resourceVmQemuTemplateRead(d, meta)
+	if err != nil {
+		return nil, err
+	}
+	if d.Id() == "" {
+		return nil, fmt.Errorf("VM %d is not a template", vmr.VmId())
+	}
+	return []*schema.ResourceData{d}, nil
+}
+
+func resourceVmQemuTemplateDelete(d *schema.ResourceData, meta interface{}) (err error) {
+	pconf := meta.(*providerConfiguration)
+	dl := resourceDeadline(d, schema.TimeoutDelete)
+	err = pmParallelBegin(pconf, dl)
+	if err != nil {
+		return err
+	}
+	defer pmParallelEnd(pconf)
+	return deleteVm(pconf.Api, templateVmRef(d), false, dl)
+}
+
+func resourceVmQemuTemplateExists(d *schema.ResourceData, meta interface{}) (exists bool, err error) {
+	pconf := meta.(*providerConfiguration)
+	err = pmParallelBegin(pconf, resourceDeadline(d, schema.TimeoutRead))
+	if err != nil {
+		return false, err
+	}
+	defer pmParallelEnd(pconf)
+
+	_, err = pconf.Api.get(vmPath(templateVmRef(d))+"/status/current", nil)
+	if err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+func templateVmRef(d *schema.ResourceData) *pxapi.VmRef {
+	vmId, _ := strconv.Atoi(d.Id())
+	vmr := pxapi.NewVmRef(vmId)
+	vmr.SetNode(d.Get("target_node").(string))
+	vmr.SetVmType(vmType)
+	return vmr
+}
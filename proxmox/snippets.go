@@ -0,0 +1,263 @@
+package proxmox
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// The API can list and delete snippets, but not upload them: files are
+// written over SSH on the node, in the snippets directory of the storage.
+type nodeSshConfig struct {
+	Username   string
+	Password   string
+	PrivateKey string
+	HostKey    string
+	Insecure   bool
+	Port       int
+}
+
+var rxSnippetVolume = regexp.MustCompile("^[A-Za-z][A-Za-z0-9._-]*:snippets/[^/]+$")
+
+func isSnippetVolume(value string) bool {
+	return rxSnippetVolume.MatchString(value)
+}
+
+// Write content as a snippet on the storage, replacing any previous version,
+// and return its volume id.
+func writeSnippet(pconf *providerConfiguration, node string, storage string, filename string, content string, dl deadline) (string, error) {
+	api := pconf.Api
+	snippetsDir, err := storageSnippetsDir(api, storage)
+	if err != nil {
+		return "", err
+	}
+	address, err := nodeAddress(api, node)
+	if err != nil {
+		return "", err
+	}
+	command := fmt.Sprintf("mkdir -p %s && cat > %s",
+		shellQuote(snippetsDir), shellQuote(path.Join(snippetsDir, filename)))
+	log.Printf("[DEBUG] writing snippet %s to %s on %s", filename, storage, node)
+	_, err = runNodeCommand(pconf.NodeSsh, node, address, command, content, dl)
+	if err != nil {
+		return "", fmt.Errorf("Cannot write snippet %s on %s: %v", filename, node, err)
+	}
+	return fmt.Sprintf("%s:snippets/%s", storage, filename), nil
+}
+
+// Content of a snippet, read over SSH as the API cannot download it either.
+func readSnippet(pconf *providerConfiguration, node string, storage string, filename string, dl deadline) (string, error) {
+	api := pconf.Api
+	snippetsDir, err := storageSnippetsDir(api, storage)
+	if err != nil {
+		return "", err
+	}
+	address, err := nodeAddress(api, node)
+	if err != nil {
+		return "", err
+	}
+	content, err := runNodeCommand(pconf.NodeSsh, node, address, "cat "+shellQuote(path.Join(snippetsDir, filename)), "", dl)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read snippet %s on %s: %v", filename, node, err)
+	}
+	return content, nil
+}
+
+// Directory of the snippets of a storage, on the nodes.
+func storageSnippetsDir(api *apiClient, storage string) (string, error) {
+	data, err := api.get("/storage/"+url.PathEscape(storage), nil)
+	if err != nil {
+		return "", err
+	}
+	storageConfig, _ := data.(map[string]interface{})
+	if !strings.Contains(fmt.Sprint(storageConfig["content"]), "snippets") {
+		return "", fmt.Errorf("Storage %s does not hold snippets, add them to its content types", storage)
+	}
+	storagePath, _ := storageConfig["path"].(string)
+	if storagePath == "" {
+		return "", fmt.Errorf("Storage %s has no directory to write snippets to", storage)
+	}
+	return path.Join(storagePath, "snippets"), nil
+}
+
+// Snippet volumes of a storage, by volume id.
+func listSnippets(api *apiClient, node string, storage string) (map[string]bool, error) {
+	data, err := api.get(
+		fmt.Sprintf("/nodes/%s/storage/%s/content", node, storage),
+		map[string]interface{}{"content": "snippets"},
+	)
+	if err != nil {
+		return nil, err
+	}
+	volumes, _ := data.([]interface{})
+	snippets := map[string]bool{}
+	for _, volume := range volumes {
+		volumeMap, _ := volume.(map[string]interface{})
+		snippets[fmt.Sprint(volumeMap["volid"])] = true
+	}
+	return snippets, nil
+}
+
+func deleteSnippet(api *apiClient, node string, volumeId string) error {
+	storage, _, _, err := parseVolumeId(volumeId)
+	if err != nil {
+		return err
+	}
+	log.Printf("[DEBUG] deleting snippet %s", volumeId)
+	_, err = api.delete(fmt.Sprintf("/nodes/%s/storage/%s/content/%s", node, storage, url.PathEscape(volumeId)), nil)
+	return err
+}
+
+// Address of a node in the cluster, or the API host when the cluster does
+// not report it.
+func nodeAddress(api *apiClient, node string) (string, error) {
+	data, err := api.get("/cluster/status", nil)
+	if err != nil {
+		return "", err
+	}
+	entries, _ := data.([]interface{})
+	for _, entry := range entries {
+		entryMap, _ := entry.(map[string]interface{})
+		if entryMap["type"] == "node" && entryMap["name"] == node {
+			if ip, _ := entryMap["ip"].(string); ip != "" {
+				return ip, nil
+			}
+		}
+	}
+	apiUrl, err := url.Parse(api.url)
+	if err != nil {
+		return "", err
+	}
+	return apiUrl.Hostname(), nil
+}
+
+// Run a command on a node, at its address, feeding it stdin, and return its
+// output. The connection, the handshake and the command are all bound by the
+// deadline.
+func runNodeCommand(sshConfig *nodeSshConfig, node string, address string, command string, stdin string, dl deadline) (string, error) {
+	clientConfig, err := sshClientConfig(sshConfig, node)
+	if err != nil {
+		return "", err
+	}
+	hostPort := net.JoinHostPort(address, strconv.Itoa(sshConfig.Port))
+	netConn, err := (&net.Dialer{Deadline: dl.time}).Dial("tcp", hostPort)
+	if err != nil {
+		if dl.expired() {
+			return "", dl.errorf("connecting to %s", hostPort)
+		}
+		return "", err
+	}
+	defer netConn.Close()
+	err = netConn.SetDeadline(dl.time)
+	if err != nil {
+		return "", err
+	}
+	sshConn, channels, requests, err := ssh.NewClientConn(netConn, hostPort, clientConfig)
+	if err != nil {
+		if dl.expired() {
+			return "", dl.errorf("connecting to %s", hostPort)
+		}
+		return "", err
+	}
+	conn := ssh.NewClient(sshConn, channels, requests)
+	defer conn.Close()
+	session, err := conn.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdin = strings.NewReader(stdin)
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	err = session.Run(command)
+	if err != nil && dl.expired() {
+		return "", dl.errorf("running a command on %s", hostPort)
+	}
+	if err != nil && stderr.Len() > 0 {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), err
+}
+
+func sshClientConfig(sshConfig *nodeSshConfig, node string) (*ssh.ClientConfig, error) {
+	if sshConfig == nil || sshConfig.Username == "" || (sshConfig.Password == "" && sshConfig.PrivateKey == "") {
+		return nil, fmt.Errorf("node_ssh_password or node_ssh_private_key is required to write snippets")
+	}
+	clientConfig := &ssh.ClientConfig{User: sshConfig.Username}
+	if sshConfig.PrivateKey != "" {
+		keyContent := []byte(sshConfig.PrivateKey)
+		if !strings.Contains(sshConfig.PrivateKey, "-----BEGIN") {
+			var err error
+			keyContent, err = ioutil.ReadFile(sshConfig.PrivateKey)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot read node_ssh_private_key: %v", err)
+			}
+		}
+		signer, err := ssh.ParsePrivateKey(keyContent)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid node_ssh_private_key: %v", err)
+		}
+		clientConfig.Auth = append(clientConfig.Auth, ssh.PublicKeys(signer))
+	}
+	if sshConfig.Password != "" {
+		clientConfig.Auth = append(clientConfig.Auth, ssh.Password(sshConfig.Password))
+	}
+	if sshConfig.Insecure {
+		clientConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		return clientConfig, nil
+	}
+	if sshConfig.HostKey == "" {
+		knownHostsFile := filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+		knownHostsCallback, err := knownhosts.New(knownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot verify the node host keys, set node_ssh_host_key or add them to %s: %v", knownHostsFile, err)
+		}
+		// known_hosts lists the nodes by name rather than by the address
+		// connected to, which is only looked up when the name is not listed
+		nodeHostPort := net.JoinHostPort(node, strconv.Itoa(sshConfig.Port))
+		clientConfig.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			err := knownHostsCallback(nodeHostPort, remote, key)
+			if keyErr, isKeyErr := err.(*knownhosts.KeyError); isKeyErr && len(keyErr.Want) == 0 {
+				return knownHostsCallback(hostname, remote, key)
+			}
+			return err
+		}
+		return clientConfig, nil
+	}
+	// one key per line, for the nodes of a cluster
+	hostKeys := map[string]bool{}
+	rest := []byte(sshConfig.HostKey)
+	for len(bytes.TrimSpace(rest)) > 0 {
+		hostKey, _, _, remaining, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid node_ssh_host_key: %v", err)
+		}
+		hostKeys[string(hostKey.Marshal())] = true
+		rest = remaining
+	}
+	clientConfig.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if !hostKeys[string(key.Marshal())] {
+			return fmt.Errorf("Host key of %s does not match node_ssh_host_key", hostname)
+		}
+		return nil
+	}
+	return clientConfig, nil
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
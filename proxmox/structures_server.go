@@ -1,6 +1,14 @@
 package proxmox
 
 import (
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
 	pxapi "github.com/enix/proxmox-api-go/proxmox"
 	"github.com/hashicorp/terraform/helper/schema"
 )
@@ -33,6 +41,15 @@ func state2ConfigQemu(d *schema.ResourceData) (config *pxapi.ConfigQemu, err err
 	if cloudInitSshkeys := d.Get("cloudinit_sshkeys").(string); cloudInitSshkeys != "" {
 		config.Sshkeys = cloudInitSshkeys
 	}
+	if nameservers := schemaStringList(d.Get("nameservers")); len(nameservers) > 0 {
+		config.Nameserver = strings.Join(nameservers, " ")
+	}
+	if searchDomains := schemaStringList(d.Get("search_domains")); len(searchDomains) > 0 {
+		config.Searchdomain = strings.Join(searchDomains, " ")
+	}
+	if sshKeys := schemaStringList(d.Get("ssh_keys")); len(sshKeys) > 0 {
+		config.Sshkeys = strings.Join(sshKeys, "\n")
+	}
 	if cloudInitIpconfig0 := d.Get("cloudinit_ipconfig0").(string); cloudInitIpconfig0 != "" {
 		config.Ipconfig0 = cloudInitIpconfig0
 	}
@@ -42,20 +59,6 @@ func state2ConfigQemu(d *schema.ResourceData) (config *pxapi.ConfigQemu, err err
 	return
 }
 
-// func devicesSetToMap(devicesSet *schema.Set) pxapi.QemuDevices {
-
-// 	devicesMap := pxapi.QemuDevices{}
-
-// 	for _, set := range devicesSet.List() {
-// 		setMap, isMap := set.(map[string]interface{})
-// 		if isMap {
-// 			setID := setMap["id"].(int)
-// 			devicesMap[setID] = setMap
-// 		}
-// 	}
-// 	return devicesMap
-// }
-
 func devicesList2QemuDevices(devicesList []interface{}) pxapi.QemuDevices {
 
 	qemuDevices := pxapi.QemuDevices{}
@@ -64,4 +67,540 @@ func devicesList2QemuDevices(devicesList []interface{}) pxapi.QemuDevices {
 		qemuDevices[deviceID] = set.(map[string]interface{})
 	}
 	return qemuDevices
-}
\ No newline at end of file
+}
+
+// Extract the nested schema of a list of devices (disk, network).
+func deviceSchema(listSchema *schema.Schema) map[string]*schema.Schema {
+	return listSchema.Elem.(*schema.Resource).Schema
+}
+
+// Convert devices as read from Proxmox API into a list ordered by device id,
+// keeping only keys known to the device schema and filling the others with
+// their schema default.
+func qemuDevices2List(qemuDevices pxapi.QemuDevices, elemSchema map[string]*schema.Schema) []interface{} {
+
+	deviceIDs := make([]int, 0, len(qemuDevices))
+	for deviceID := range qemuDevices {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	sort.Ints(deviceIDs)
+
+	devicesList := make([]interface{}, 0, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		device := map[string]interface{}{}
+		for key, keySchema := range elemSchema {
+			if value, ok := qemuDevices[deviceID][key]; ok {
+				device[key] = deviceValue2Schema(value, keySchema.Type)
+			} else if keySchema.Default != nil {
+				device[key] = keySchema.Default
+			}
+		}
+		devicesList = append(devicesList, device)
+	}
+	return devicesList
+}
+
+// Proxmox uses `key=<0|1>` and numbers in device strings, whereas the
+// Terraform schema uses proper booleans and integers.
+func deviceValue2Schema(value interface{}, valueType schema.ValueType) interface{} {
+	sValue := fmt.Sprint(value)
+	switch valueType {
+	case schema.TypeBool:
+		if bValue, err := strconv.ParseBool(sValue); err == nil {
+			return bValue
+		}
+	case schema.TypeInt:
+		// JSON numbers decode to float64, which fmt prints as 1e+06 from
+		// a million on
+		if fValue, isFloat := value.(float64); isFloat && fValue == math.Trunc(fValue) {
+			return int(fValue)
+		}
+		if iValue, err := strconv.Atoi(sValue); err == nil {
+			return iValue
+		}
+	case schema.TypeString:
+		return sValue
+	}
+	return value
+}
+
+// Value of key in a configuration read from the API, or defaultValue if
+// Proxmox omitted it, as it does for unchanged defaults.
+func configValue(config map[string]interface{}, key string, defaultValue interface{}) interface{} {
+	if value, ok := config[key]; ok {
+		return value
+	}
+	return defaultValue
+}
+
+// Arguments of proxmox_vm_qemu that map directly to a configuration key.
+var qemuConfigArgs = map[string]string{
+	"desc":                   "description",
+	"onboot":                 "onboot",
+	"memory":                 "memory",
+	"cores":                  "cores",
+	"sockets":                "sockets",
+	"qemu_os":                "ostype",
+	"cloudinit_user":         "ciuser",
+	"cloudinit_password":     "cipassword",
+	"cloudinit_searchdomain": "searchdomain",
+	"cloudinit_nameserver":   "nameserver",
+	"cloudinit_sshkeys":      "sshkeys",
+	"cloudinit_ipconfig0":    "ipconfig0",
+	"cloudinit_ipconfig1":    "ipconfig1",
+}
+
+// The part of *schema.ResourceData that qemuConfigChanges and
+// qemuLegacyCloudInit read.
+type resourceChanges interface {
+	HasChange(key string) bool
+	Get(key string) interface{}
+	GetChange(key string) (interface{}, interface{})
+}
+
+// Build the configuration parameters of the arguments that changed, along
+// with the keys to remove. currentConfig is the VM configuration as read from
+// the API, holding the volumes of the existing disks.
+func qemuConfigChanges(d resourceChanges, currentConfig map[string]interface{}) (params map[string]interface{}, deletes []string, err error) {
+	params = map[string]interface{}{}
+	for arg, key := range qemuConfigArgs {
+		if !d.HasChange(arg) {
+			continue
+		}
+		value := d.Get(arg)
+		if sValue, isString := value.(string); isString && sValue == "" {
+			deletes = append(deletes, key)
+			continue
+		}
+		if key == "sshkeys" {
+			value = urlEncodeSshKeys(value.(string))
+		}
+		params[key] = value
+	}
+
+	for arg, key := range qemuConfigListArgs {
+		if !d.HasChange(arg) {
+			continue
+		}
+		items := schemaStringList(d.Get(arg))
+		if len(items) == 0 {
+			deletes = append(deletes, key)
+			continue
+		}
+		if key == "sshkeys" {
+			params[key] = urlEncodeSshKeys(strings.Join(items, "\n"))
+		} else {
+			params[key] = strings.Join(items, " ")
+		}
+	}
+
+	if d.HasChange("ipconfig") {
+		oldIpconfigs, newIpconfigs := d.GetChange("ipconfig")
+		oldParams := ipconfigParams(oldIpconfigs.([]interface{}))
+		newParams := ipconfigParams(newIpconfigs.([]interface{}))
+		for key, value := range newParams {
+			if oldParams[key] != value {
+				params[key] = value
+			}
+		}
+		for key := range oldParams {
+			if _, ok := newParams[key]; !ok {
+				deletes = append(deletes, key)
+			}
+		}
+	}
+
+	if d.HasChange("network") {
+		oldNetworks, newNetworks := d.GetChange("network")
+		oldList := oldNetworks.([]interface{})
+		for netID, network := range newNetworks.([]interface{}) {
+			netMap := network.(map[string]interface{})
+			if netID < len(oldList) {
+				oldMap := oldList[netID].(map[string]interface{})
+				if netMap["macaddr"] == "" {
+					netMap["macaddr"] = oldMap["macaddr"]
+				}
+				if qemuNetwork2String(netMap) == qemuNetwork2String(oldMap) {
+					continue
+				}
+			}
+			params[fmt.Sprintf("net%d", netID)] = qemuNetwork2String(netMap)
+		}
+		for netID := len(newNetworks.([]interface{})); netID < len(oldList); netID++ {
+			deletes = append(deletes, fmt.Sprintf("net%d", netID))
+		}
+	}
+
+	if d.HasChange("disk") {
+		oldDisks, newDisks := d.GetChange("disk")
+		oldList := oldDisks.([]interface{})
+		for diskID, disk := range newDisks.([]interface{}) {
+			diskMap := disk.(map[string]interface{})
+			diskName := fmt.Sprintf("%v%d", diskMap["type"], diskID)
+			if diskID < len(oldList) {
+				oldMap := oldList[diskID].(map[string]interface{})
+				if oldName := fmt.Sprintf("%v%d", oldMap["type"], diskID); oldName != diskName {
+					deletes = append(deletes, oldName)
+				}
+			}
+			// keep the volume already there, such as a cloned disk
+			current, _ := currentConfig[diskName].(string)
+			if strings.Contains(current, "media=cdrom") {
+				current = ""
+			}
+			diskConf, err := qemuDisk2String(diskMap, current)
+			if err != nil {
+				return nil, nil, err
+			}
+			if current != "" && sameDiskOptions(current, diskConf) {
+				continue
+			}
+			params[diskName] = diskConf
+		}
+		for diskID := len(newDisks.([]interface{})); diskID < len(oldList); diskID++ {
+			oldMap := oldList[diskID].(map[string]interface{})
+			deletes = append(deletes, fmt.Sprintf("%v%d", oldMap["type"], diskID))
+		}
+	}
+
+	// switching from a string argument to its list counterpart
+	keptDeletes := []string{}
+	for _, key := range deletes {
+		if _, ok := params[key]; !ok {
+			keptDeletes = append(keptDeletes, key)
+		}
+	}
+	return params, keptDeletes, nil
+}
+
+// List arguments of proxmox_vm_qemu, by configuration key. Keys are space
+// separated lists, except sshkeys which holds one key per line.
+var qemuConfigListArgs = map[string]string{
+	"nameservers":    "nameserver",
+	"search_domains": "searchdomain",
+	"ssh_keys":       "sshkeys",
+}
+
+func schemaStringList(value interface{}) []string {
+	items := []string{}
+	for _, item := range value.([]interface{}) {
+		items = append(items, strings.TrimSpace(item.(string)))
+	}
+	return items
+}
+
+// Items of a list configuration key as read from the API.
+func configList(apiConfig map[string]interface{}, key string) []string {
+	value, _ := apiConfig[key].(string)
+	if key != "sshkeys" {
+		return strings.Fields(value)
+	}
+	decoded, err := url.PathUnescape(value)
+	if err == nil {
+		value = decoded
+	}
+	items := []string{}
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			items = append(items, line)
+		}
+	}
+	return items
+}
+
+// Keep the configured order when the VM holds the same items, so that only
+// actual additions and removals show up as a diff.
+func updateConfigList(configItems []interface{}, activeItems []string) []string {
+	if len(configItems) != len(activeItems) {
+		return activeItems
+	}
+	activeCount := map[string]int{}
+	for _, item := range activeItems {
+		activeCount[item]++
+	}
+	for _, item := range configItems {
+		trimmed := strings.TrimSpace(item.(string))
+		if activeCount[trimmed] == 0 {
+			return activeItems
+		}
+		activeCount[trimmed]--
+	}
+	items := make([]string, len(configItems))
+	for i, item := range configItems {
+		items[i] = item.(string)
+	}
+	return items
+}
+
+// netN value: <model>[=<macaddr>],bridge=<bridge>[,options]
+func qemuNetwork2String(network map[string]interface{}) string {
+	netConf := fmt.Sprint(network["model"])
+	if macaddr, _ := network["macaddr"].(string); macaddr != "" {
+		netConf += "=" + strings.ToUpper(macaddr)
+	}
+	netConf += fmt.Sprintf(",bridge=%v", network["bridge"])
+	for _, option := range []string{"tag", "rate", "queues"} {
+		if value, _ := network[option].(int); value >= 0 {
+			netConf += fmt.Sprintf(",%s=%d", option, value)
+		}
+	}
+	for _, option := range []string{"firewall", "link_down"} {
+		if enabled, _ := network[option].(bool); enabled {
+			netConf += fmt.Sprintf(",%s=1", option)
+		}
+	}
+	return netConf
+}
+
+// Value of a disk key: the current value with the options of the schema set
+// on it, keeping the others such as discard or ssd, or a new volume allocated
+// on the disk storage if current is empty.
+func qemuDisk2String(disk map[string]interface{}, current string) (string, error) {
+	if current != "" {
+		return mergeDeviceOptions(current, disk, qemuDiskOptions...), nil
+	}
+	size, err := sizeGB(fmt.Sprint(disk["size"]))
+	if err != nil {
+		return "", err
+	}
+	volume := fmt.Sprintf("%v:%v,format=%v", disk["storage"], math.Ceil(size), disk["format"])
+	return deviceString(volume, disk, qemuDiskOptions...), nil
+}
+
+// Disk options of the schema, in the order they are written.
+var qemuDiskOptions = []string{"cache", "backup", "iothread", "replicate"}
+
+// Value of the disk options when missing from the configuration, as Proxmox
+// sees them. backup and replicate are enabled unless set to 0, unlike in the
+// schema, so they are written explicitly when disabled.
+var qemuDiskDefaults = map[string]string{
+	"cache":     "none",
+	"backup":    "1",
+	"iothread":  "0",
+	"replicate": "1",
+}
+
+// Fill the options missing from disks read from the API with the values
+// Proxmox uses for them, rather than letting the schema defaults hide a drift.
+func completeDiskDefaults(disks pxapi.QemuDevices) {
+	for _, disk := range disks {
+		for option, defaultValue := range qemuDiskDefaults {
+			if _, ok := disk[option]; !ok {
+				disk[option] = defaultValue
+			}
+		}
+	}
+}
+
+// Whether a disk value read from the API has the volume and the options of
+// wanted, ignoring the ones Proxmox adds on its own such as size.
+func sameDiskOptions(current string, wanted string) bool {
+	currentOptions := deviceOptions(current)
+	wantedOptions := deviceOptions(wanted)
+	if currentOptions["volume"] != wantedOptions["volume"] {
+		return false
+	}
+	for option, defaultValue := range qemuDiskDefaults {
+		currentValue, ok := currentOptions[option]
+		if !ok {
+			currentValue = defaultValue
+		}
+		if currentValue != wantedOptions[option] {
+			return false
+		}
+	}
+	return true
+}
+
+// Split a device value into its options, the leading one being the volume.
+func deviceOptions(device string) map[string]string {
+	options := map[string]string{}
+	for i, option := range strings.Split(device, ",") {
+		if i == 0 {
+			options["volume"] = option
+			continue
+		}
+		keyValue := strings.SplitN(option, "=", 2)
+		if len(keyValue) == 2 {
+			options[keyValue[0]] = keyValue[1]
+		}
+	}
+	return options
+}
+
+// Proxmox expects the keys URL encoded, with spaces as %20.
+func urlEncodeSshKeys(sshKeys string) string {
+	return strings.Replace(url.QueryEscape(strings.TrimSpace(sshKeys)), "+", "%20", -1)
+}
+
+// Options of an ipconfigN value by ipconfig block argument.
+var ipconfigOptions = []struct{ arg, option string }{
+	{"ipv4", "ip"},
+	{"gateway", "gw"},
+	{"ipv6", "ip6"},
+	{"gateway6", "gw6"},
+}
+
+// ipconfigN values of the ipconfig blocks, e.g. ip=10.0.0.2/24,gw=10.0.0.1
+func ipconfigParams(ipconfigs []interface{}) map[string]interface{} {
+	params := map[string]interface{}{}
+	for _, ipconfig := range ipconfigs {
+		ipconfigMap := ipconfig.(map[string]interface{})
+		options := []string{}
+		for _, o := range ipconfigOptions {
+			if value, _ := ipconfigMap[o.arg].(string); value != "" {
+				options = append(options, o.option+"="+value)
+			}
+		}
+		params[fmt.Sprintf("ipconfig%d", ipconfigMap["index"])] = strings.Join(options, ",")
+	}
+	return params
+}
+
+// All the ipconfig blocks of a VM configuration, ordered by index.
+func configIpconfigList(apiConfig map[string]interface{}) []interface{} {
+	indexes := []int{}
+	for key := range apiConfig {
+		if match := rxIpconfigKey.FindStringSubmatch(key); match != nil {
+			index, _ := strconv.Atoi(match[1])
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+	configIpconfigs := make([]interface{}, len(indexes))
+	for i, index := range indexes {
+		configIpconfigs[i] = map[string]interface{}{"index": index}
+	}
+	return updateIpconfigList(configIpconfigs, apiConfig)
+}
+
+var rxIpconfigKey = regexp.MustCompile("^ipconfig([0-9]+)$")
+
+// Refresh the configured ipconfig blocks, in their order, from the ipconfigN
+// values of the VM configuration. Blocks missing from the VM are left out.
+func updateIpconfigList(configIpconfigs []interface{}, apiConfig map[string]interface{}) []interface{} {
+	ipconfigs := make([]interface{}, 0, len(configIpconfigs))
+	for _, ipconfig := range configIpconfigs {
+		index := ipconfig.(map[string]interface{})["index"].(int)
+		value, ok := apiConfig[fmt.Sprintf("ipconfig%d", index)].(string)
+		if !ok {
+			continue
+		}
+		options := deviceOptions("," + value)
+		ipconfigMap := map[string]interface{}{"index": index}
+		for _, o := range ipconfigOptions {
+			ipconfigMap[o.arg] = options[o.option]
+		}
+		ipconfigs = append(ipconfigs, ipconfigMap)
+	}
+	return ipconfigs
+}
+
+// Values to read back into the string forms of the cloud-init settings.
+// Each is only read while the list or blocks replacing it are not in use,
+// otherwise both would be set and the plan would never settle.
+func qemuLegacyCloudInit(d resourceChanges, config *pxapi.ConfigQemu) map[string]string {
+	legacyValues := map[string]string{}
+	for _, legacy := range []struct {
+		arg     string
+		value   string
+		listArg string
+	}{
+		{"cloudinit_searchdomain", config.Searchdomain, "search_domains"},
+		{"cloudinit_nameserver", config.Nameserver, "nameservers"},
+		{"cloudinit_sshkeys", config.Sshkeys, "ssh_keys"},
+		{"cloudinit_ipconfig0", config.Ipconfig0, "ipconfig"},
+		{"cloudinit_ipconfig1", config.Ipconfig1, "ipconfig"},
+	} {
+		if legacy.value != "" && len(d.Get(legacy.listArg).([]interface{})) == 0 {
+			legacyValues[legacy.arg] = legacy.value
+		}
+	}
+	return legacyValues
+}
+
+// Format `[volume,]key=value,...` from the given keys of device, skipping
+// unset values.
+func deviceString(volume string, device map[string]interface{}, keys ...string) string {
+	confs := []string{}
+	if volume != "" {
+		confs = append(confs, volume)
+	}
+	for _, key := range keys {
+		switch value := device[key].(type) {
+		case string:
+			if value != "" {
+				confs = append(confs, key+"="+value)
+			}
+		case int:
+			if value >= 0 {
+				confs = append(confs, fmt.Sprintf("%s=%d", key, value))
+			}
+		case bool:
+			if value {
+				confs = append(confs, key+"=1")
+			} else {
+				confs = append(confs, key+"=0")
+			}
+		}
+	}
+	return strings.Join(confs, ",")
+}
+
+// Set the given keys of device on an existing `volume,key=value,...` string,
+// keeping the volume and the other options.
+func mergeDeviceOptions(current string, device map[string]interface{}, keys ...string) string {
+	values := map[string]string{}
+	for _, key := range keys {
+		values[key] = ""
+	}
+	for _, item := range strings.Split(deviceString("", device, keys...), ",") {
+		if keyValue := strings.SplitN(item, "=", 2); len(keyValue) == 2 {
+			values[keyValue[0]] = item
+		}
+	}
+	items := strings.Split(current, ",")
+	confs := []string{items[0]}
+	for _, item := range items[1:] {
+		if _, ok := values[strings.SplitN(item, "=", 2)[0]]; !ok {
+			confs = append(confs, item)
+		}
+	}
+	for _, key := range keys {
+		if values[key] != "" {
+			confs = append(confs, values[key])
+		}
+	}
+	return strings.Join(confs, ",")
+}
+
+// Parse `[volume,]key=value,...`. When volumeKey is given, the first item is
+// the volume, which also gives the storage.
+func parseDevice(conf string, volumeKey string) map[string]interface{} {
+	device := map[string]interface{}{}
+	for i, item := range strings.Split(conf, ",") {
+		if i == 0 && volumeKey != "" {
+			device[volumeKey] = item
+			device["storage"] = strings.SplitN(item, ":", 2)[0]
+			continue
+		}
+		keyValue := strings.SplitN(item, "=", 2)
+		if len(keyValue) == 2 {
+			device[keyValue[0]] = keyValue[1]
+		}
+	}
+	return device
+}
+
+var rxSize = regexp.MustCompile("^(\\d+(?:\\.\\d+)?)([KMGT]?)$")
+
+// Convert a size such as 512M or 8G into GB, the unit used to allocate volumes.
+func sizeGB(size string) (float64, error) {
+	match := rxSize.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(size)))
+	if match == nil {
+		return 0, fmt.Errorf("Invalid size: %s", size)
+	}
+	value, _ := strconv.ParseFloat(match[1], 64)
+	units := map[string]float64{"K": 1.0 / 1024 / 1024, "M": 1.0 / 1024, "G": 1, "T": 1024, "": 1}
+	return value * units[match[2]], nil
+}
@@ -0,0 +1,370 @@
+package proxmox
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	pxapi "github.com/enix/proxmox-api-go/proxmox"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// Resource data given by its values before and after the plan.
+type fakeChanges struct {
+	old map[string]interface{}
+	new map[string]interface{}
+}
+
+func (f fakeChanges) HasChange(key string) bool {
+	return !reflect.DeepEqual(f.old[key], f.new[key])
+}
+
+func (f fakeChanges) Get(key string) interface{} {
+	return f.new[key]
+}
+
+func (f fakeChanges) GetChange(key string) (interface{}, interface{}) {
+	return f.old[key], f.new[key]
+}
+
+func testDisk(diskType string, backup bool) map[string]interface{} {
+	return map[string]interface{}{
+		"type":      diskType,
+		"storage":   "local-lvm",
+		"size":      "10G",
+		"format":    "raw",
+		"cache":     "none",
+		"backup":    backup,
+		"iothread":  false,
+		"replicate": false,
+	}
+}
+
+func testNetwork(macaddr string) map[string]interface{} {
+	return map[string]interface{}{
+		"model":     "virtio",
+		"macaddr":   macaddr,
+		"bridge":    "vmbr0",
+		"tag":       -1,
+		"rate":      -1,
+		"queues":    -1,
+		"firewall":  false,
+		"link_down": false,
+	}
+}
+
+func TestQemuConfigChanges(t *testing.T) {
+	cases := []struct {
+		name          string
+		old           map[string]interface{}
+		new           map[string]interface{}
+		currentConfig map[string]interface{}
+		params        map[string]interface{}
+		deletes       []string
+	}{
+		{
+			name:   "scalar",
+			old:    map[string]interface{}{"memory": 512, "cores": 2},
+			new:    map[string]interface{}{"memory": 1024, "cores": 2},
+			params: map[string]interface{}{"memory": 1024},
+		},
+		{
+			name:    "cleared string",
+			old:     map[string]interface{}{"desc": "web server"},
+			new:     map[string]interface{}{"desc": ""},
+			params:  map[string]interface{}{},
+			deletes: []string{"description"},
+		},
+		{
+			name:   "ssh key",
+			old:    map[string]interface{}{"cloudinit_sshkeys": ""},
+			new:    map[string]interface{}{"cloudinit_sshkeys": "ssh-ed25519 AAAA user@host\n"},
+			params: map[string]interface{}{"sshkeys": "ssh-ed25519%20AAAA%20user%40host"},
+		},
+		{
+			name: "string to list",
+			old: map[string]interface{}{
+				"cloudinit_nameserver": "1.1.1.1",
+				"nameservers":          []interface{}{},
+				"cloudinit_sshkeys":    "ssh-ed25519 AAAA",
+				"ssh_keys":             []interface{}{},
+			},
+			new: map[string]interface{}{
+				"cloudinit_nameserver": "",
+				"nameservers":          []interface{}{"1.1.1.1", " 8.8.8.8"},
+				"cloudinit_sshkeys":    "",
+				"ssh_keys":             []interface{}{"ssh-ed25519 AAAA", "ssh-rsa BBBB"},
+			},
+			params: map[string]interface{}{
+				"nameserver": "1.1.1.1 8.8.8.8",
+				"sshkeys":    "ssh-ed25519%20AAAA%0Assh-rsa%20BBBB",
+			},
+		},
+		{
+			name:    "list to string",
+			old:     map[string]interface{}{"cloudinit_searchdomain": "", "search_domains": []interface{}{"example.com"}},
+			new:     map[string]interface{}{"cloudinit_searchdomain": "example.org", "search_domains": []interface{}{}},
+			params:  map[string]interface{}{"searchdomain": "example.org"},
+			deletes: []string{},
+		},
+		{
+			name:    "cleared list",
+			old:     map[string]interface{}{"search_domains": []interface{}{"example.com"}},
+			new:     map[string]interface{}{"search_domains": []interface{}{}},
+			params:  map[string]interface{}{},
+			deletes: []string{"searchdomain"},
+		},
+		{
+			name: "ipconfig",
+			old: map[string]interface{}{"ipconfig": []interface{}{
+				map[string]interface{}{"index": 0, "ipv4": "dhcp"},
+				map[string]interface{}{"index": 1, "ipv4": "10.0.0.2/24"},
+			}},
+			new: map[string]interface{}{"ipconfig": []interface{}{
+				map[string]interface{}{"index": 0, "ipv4": "dhcp"},
+				map[string]interface{}{"index": 2, "ipv4": "10.0.1.2/24", "gateway": "10.0.1.1"},
+			}},
+			params:  map[string]interface{}{"ipconfig2": "ip=10.0.1.2/24,gw=10.0.1.1"},
+			deletes: []string{"ipconfig1"},
+		},
+		{
+			name:   "network keeps its mac address",
+			old:    map[string]interface{}{"network": []interface{}{testNetwork("AA:BB:CC:DD:EE:FF")}},
+			new:    map[string]interface{}{"network": []interface{}{testNetwork(""), testNetwork("aa:bb:cc:dd:ee:00")}},
+			params: map[string]interface{}{"net1": "virtio=AA:BB:CC:DD:EE:00,bridge=vmbr0"},
+		},
+		{
+			name:          "cloned network gets the pinned mac address",
+			old:           map[string]interface{}{"network": []interface{}{}},
+			new:           map[string]interface{}{"network": []interface{}{testNetwork("52:54:00:12:34:56")}},
+			currentConfig: map[string]interface{}{"net0": "virtio=BC:24:11:00:00:01,bridge=vmbr0"},
+			params:        map[string]interface{}{"net0": "virtio=52:54:00:12:34:56,bridge=vmbr0"},
+		},
+		{
+			name:    "removed network",
+			old:     map[string]interface{}{"network": []interface{}{testNetwork("AA:BB:CC:DD:EE:FF"), testNetwork("AA:BB:CC:DD:EE:00")}},
+			new:     map[string]interface{}{"network": []interface{}{testNetwork("AA:BB:CC:DD:EE:FF")}},
+			params:  map[string]interface{}{},
+			deletes: []string{"net1"},
+		},
+		{
+			name:   "new disk",
+			old:    map[string]interface{}{"disk": []interface{}{}},
+			new:    map[string]interface{}{"disk": []interface{}{testDisk("scsi", false)}},
+			params: map[string]interface{}{"scsi0": "local-lvm:10,format=raw,cache=none,backup=0,iothread=0,replicate=0"},
+		},
+		{
+			name:          "existing disk keeps its options",
+			old:           map[string]interface{}{"disk": []interface{}{testDisk("scsi", false)}},
+			new:           map[string]interface{}{"disk": []interface{}{testDisk("scsi", true)}},
+			currentConfig: map[string]interface{}{"scsi0": "local-lvm:vm-100-disk-0,discard=on,backup=0,size=10G,ssd=1"},
+			params:        map[string]interface{}{"scsi0": "local-lvm:vm-100-disk-0,discard=on,size=10G,ssd=1,cache=none,backup=1,iothread=0,replicate=0"},
+		},
+		{
+			name:          "cloned disk with default options",
+			old:           map[string]interface{}{"disk": []interface{}{}},
+			new:           map[string]interface{}{"disk": []interface{}{testDisk("scsi", false)}},
+			currentConfig: map[string]interface{}{"scsi0": "local-lvm:vm-100-disk-0,size=10G"},
+			params:        map[string]interface{}{"scsi0": "local-lvm:vm-100-disk-0,size=10G,cache=none,backup=0,iothread=0,replicate=0"},
+		},
+		{
+			name:          "cloned disk matching the defaults",
+			old:           map[string]interface{}{"disk": []interface{}{}},
+			new:           map[string]interface{}{"disk": []interface{}{testDisk("scsi", true)}},
+			currentConfig: map[string]interface{}{"scsi0": "local-lvm:vm-100-disk-0,size=10G,replicate=0"},
+			params:        map[string]interface{}{},
+		},
+		{
+			name:          "disk type",
+			old:           map[string]interface{}{"disk": []interface{}{testDisk("scsi", false)}},
+			new:           map[string]interface{}{"disk": []interface{}{testDisk("virtio", false)}},
+			currentConfig: map[string]interface{}{"scsi0": "local-lvm:vm-100-disk-0,size=10G"},
+			params:        map[string]interface{}{"virtio0": "local-lvm:10,format=raw,cache=none,backup=0,iothread=0,replicate=0"},
+			deletes:       []string{"scsi0"},
+		},
+	}
+
+	for _, c := range cases {
+		currentConfig := c.currentConfig
+		if currentConfig == nil {
+			currentConfig = map[string]interface{}{}
+		}
+		params, deletes, err := qemuConfigChanges(fakeChanges{c.old, c.new}, currentConfig)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(params, c.params) {
+			t.Errorf("%s: params are %v, expected %v", c.name, params, c.params)
+		}
+		sort.Strings(deletes)
+		if len(deletes) != len(c.deletes) || (len(deletes) > 0 && !reflect.DeepEqual(deletes, c.deletes)) {
+			t.Errorf("%s: deletes are %v, expected %v", c.name, deletes, c.deletes)
+		}
+	}
+}
+
+func TestQemuLegacyCloudInit(t *testing.T) {
+	config := &pxapi.ConfigQemu{
+		Searchdomain: "example.com",
+		Nameserver:   "1.1.1.1",
+		Sshkeys:      "ssh-ed25519%20AAAA",
+		Ipconfig0:    "ip=dhcp",
+		Ipconfig1:    "ip=10.0.0.2/24",
+	}
+	noLists := map[string]interface{}{
+		"search_domains": []interface{}{},
+		"nameservers":    []interface{}{},
+		"ssh_keys":       []interface{}{},
+		"ipconfig":       []interface{}{},
+	}
+	cases := []struct {
+		name   string
+		lists  map[string]interface{}
+		config *pxapi.ConfigQemu
+		values map[string]string
+	}{
+		{
+			name:   "strings in use",
+			lists:  map[string]interface{}{},
+			config: config,
+			values: map[string]string{
+				"cloudinit_searchdomain": "example.com",
+				"cloudinit_nameserver":   "1.1.1.1",
+				"cloudinit_sshkeys":      "ssh-ed25519%20AAAA",
+				"cloudinit_ipconfig0":    "ip=dhcp",
+				"cloudinit_ipconfig1":    "ip=10.0.0.2/24",
+			},
+		},
+		{
+			name:   "unset",
+			lists:  map[string]interface{}{},
+			config: &pxapi.ConfigQemu{Nameserver: "1.1.1.1"},
+			values: map[string]string{"cloudinit_nameserver": "1.1.1.1"},
+		},
+		{
+			name: "lists in use",
+			lists: map[string]interface{}{
+				"search_domains": []interface{}{"example.com"},
+				"nameservers":    []interface{}{"1.1.1.1"},
+				"ssh_keys":       []interface{}{"ssh-ed25519 AAAA"},
+			},
+			config: config,
+			values: map[string]string{
+				"cloudinit_ipconfig0": "ip=dhcp",
+				"cloudinit_ipconfig1": "ip=10.0.0.2/24",
+			},
+		},
+		{
+			name: "ipconfig blocks in use",
+			lists: map[string]interface{}{"ipconfig": []interface{}{
+				map[string]interface{}{"index": 0, "ipv4": "dhcp"},
+				map[string]interface{}{"index": 1, "ipv4": "10.0.0.2/24"},
+			}},
+			config: config,
+			values: map[string]string{
+				"cloudinit_searchdomain": "example.com",
+				"cloudinit_nameserver":   "1.1.1.1",
+				"cloudinit_sshkeys":      "ssh-ed25519%20AAAA",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		state := map[string]interface{}{}
+		for arg, list := range noLists {
+			state[arg] = list
+		}
+		for arg, list := range c.lists {
+			state[arg] = list
+		}
+		values := qemuLegacyCloudInit(fakeChanges{state, state}, c.config)
+		if !reflect.DeepEqual(values, c.values) {
+			t.Errorf("%s: values are %v, expected %v", c.name, values, c.values)
+		}
+	}
+}
+
+func TestDeviceValue2Schema(t *testing.T) {
+	cases := []struct {
+		name      string
+		value     interface{}
+		valueType schema.ValueType
+		expected  interface{}
+	}{
+		{"string int", "100", schema.TypeInt, 100},
+		{"json int", float64(100), schema.TypeInt, 100},
+		{"large json int", float64(1000000), schema.TypeInt, 1000000},
+		{"json fraction", 1.5, schema.TypeInt, 1.5},
+		{"not a number", "abc", schema.TypeInt, "abc"},
+		{"bool", "1", schema.TypeBool, true},
+		{"string", float64(1000000), schema.TypeString, "1e+06"},
+	}
+
+	for _, c := range cases {
+		value := deviceValue2Schema(c.value, c.valueType)
+		if !reflect.DeepEqual(value, c.expected) {
+			t.Errorf("%s: value is %#v, expected %#v", c.name, value, c.expected)
+		}
+	}
+}
+
+func TestConfigList(t *testing.T) {
+	cases := []struct {
+		name   string
+		key    string
+		config map[string]interface{}
+		items  []string
+	}{
+		{"missing", "nameserver", map[string]interface{}{}, []string{}},
+		{"spaces", "nameserver", map[string]interface{}{"nameserver": " 1.1.1.1  8.8.8.8 "}, []string{"1.1.1.1", "8.8.8.8"}},
+		{"search domains", "searchdomain", map[string]interface{}{"searchdomain": "example.com example.org"}, []string{"example.com", "example.org"}},
+		{
+			"url encoded ssh keys", "sshkeys",
+			map[string]interface{}{"sshkeys": "ssh-ed25519%20AAAA%20user%40host%0Assh-rsa%20BBBB%0A"},
+			[]string{"ssh-ed25519 AAAA user@host", "ssh-rsa BBBB"},
+		},
+		{
+			"plain ssh keys", "sshkeys",
+			map[string]interface{}{"sshkeys": "ssh-ed25519 AAAA\n\n ssh-rsa BBBB"},
+			[]string{"ssh-ed25519 AAAA", "ssh-rsa BBBB"},
+		},
+		{
+			"invalid encoding", "sshkeys",
+			map[string]interface{}{"sshkeys": "ssh-rsa BBBB 100%"},
+			[]string{"ssh-rsa BBBB 100%"},
+		},
+	}
+
+	for _, c := range cases {
+		items := configList(c.config, c.key)
+		if len(items) != len(c.items) || (len(items) > 0 && !reflect.DeepEqual(items, c.items)) {
+			t.Errorf("%s: items are %q, expected %q", c.name, items, c.items)
+		}
+	}
+}
+
+func TestUpdateConfigList(t *testing.T) {
+	cases := []struct {
+		name        string
+		configItems []interface{}
+		activeItems []string
+		items       []string
+	}{
+		{"same order", []interface{}{"a", "b"}, []string{"a", "b"}, []string{"a", "b"}},
+		{"configured order", []interface{}{"b", "a"}, []string{"a", "b"}, []string{"b", "a"}},
+		{"configured spaces", []interface{}{" a", "b "}, []string{"a", "b"}, []string{" a", "b "}},
+		{"added", []interface{}{"a"}, []string{"a", "b"}, []string{"a", "b"}},
+		{"removed", []interface{}{"a", "b"}, []string{"b"}, []string{"b"}},
+		{"replaced", []interface{}{"a", "b"}, []string{"a", "c"}, []string{"a", "c"}},
+		{"duplicates", []interface{}{"a", "a"}, []string{"a", "b"}, []string{"a", "b"}},
+		{"not configured", []interface{}{}, []string{"a"}, []string{"a"}},
+	}
+
+	for _, c := range cases {
+		items := updateConfigList(c.configItems, c.activeItems)
+		if !reflect.DeepEqual(items, c.items) {
+			t.Errorf("%s: items are %q, expected %q", c.name, items, c.items)
+		}
+	}
+}
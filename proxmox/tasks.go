@@ -0,0 +1,377 @@
+package proxmox
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	pxapi "github.com/enix/proxmox-api-go/proxmox"
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+const (
+	defaultTaskTimeout = 10 * time.Minute
+	taskPollInterval   = time.Second
+	taskLogTailLines   = 10
+)
+
+// deadline bounds all the waits of an operation, so that a stalled step
+// fails with the name of the operation instead of hanging.
+type deadline struct {
+	operation string
+	time      time.Time
+}
+
+func newDeadline(operation string, timeout time.Duration) deadline {
+	return deadline{operation: operation, time: time.Now().Add(timeout)}
+}
+
+// Deadline of a resource operation (schema.TimeoutCreate, ...), as set in
+// the resource timeouts block.
+func resourceDeadline(d *schema.ResourceData, operation string) deadline {
+	return newDeadline(operation, d.Timeout(operation))
+}
+
+func (dl deadline) expired() bool {
+	return time.Now().After(dl.time)
+}
+
+func (dl deadline) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("Timeout of %s operation while "+format, append([]interface{}{dl.operation}, a...)...)
+}
+
+// Start a long running call and wait for the task it returns to complete.
+// Calls that complete synchronously return no task and are done already.
+func runTask(api *apiClient, method string, path string, params map[string]interface{}, dl deadline) error {
+	data, err := api.request(method, path, params)
+	if err != nil {
+		return err
+	}
+	upid, isString := data.(string)
+	if !isString || upid == "" {
+		return nil
+	}
+	return waitForTask(api, upid, dl)
+}
+
+// Like runTask, for the request that creates vmr. When the id is taken, the
+// request itself fails before any task is started, with a vmIdConflictError.
+func runCreateTask(api *apiClient, method string, path string, params map[string]interface{}, vmr *pxapi.VmRef, dl deadline) error {
+	data, err := api.request(method, path, params)
+	if err != nil {
+		if isVmIdConflict(err, vmr.VmId()) {
+			return &vmIdConflictError{err}
+		}
+		return err
+	}
+	upid, isString := data.(string)
+	if !isString || upid == "" {
+		return nil
+	}
+	return waitForTask(api, upid, dl)
+}
+
+// Poll the status of a task until it stops, and fail with the end of its log
+// if it did not exit successfully.
+func waitForTask(api *apiClient, upid string, dl deadline) error {
+	node, err := upidNode(upid)
+	if err != nil {
+		return err
+	}
+	taskPath := fmt.Sprintf("/nodes/%s/tasks/%s", node, url.PathEscape(upid))
+	for {
+		data, err := api.get(taskPath+"/status", nil)
+		if err != nil {
+			return err
+		}
+		status, _ := data.(map[string]interface{})
+		if status["status"] == "stopped" {
+			exitStatus := fmt.Sprint(status["exitstatus"])
+			if exitStatus == "OK" || strings.HasPrefix(exitStatus, "WARNINGS") {
+				return nil
+			}
+			return fmt.Errorf("Task %s failed: %s\n%s", upid, exitStatus, taskLogTail(api, taskPath))
+		}
+		if dl.expired() {
+			return dl.errorf("waiting for task %s\n%s", upid, taskLogTail(api, taskPath))
+		}
+		time.Sleep(taskPollInterval)
+	}
+}
+
+// UPID:<node>:<pid>:<pstart>:<starttime>:<type>:<id>:<user>:
+func upidNode(upid string) (string, error) {
+	parts := strings.Split(upid, ":")
+	if len(parts) < 3 || parts[0] != "UPID" {
+		return "", fmt.Errorf("Invalid task id: %s", upid)
+	}
+	return parts[1], nil
+}
+
+// The log is paged: read its length first, then its last lines.
+func taskLogTail(api *apiClient, taskPath string) string {
+	_, total, err := api.getPage(taskPath+"/log", 0, 1)
+	if err != nil {
+		log.Printf("[DEBUG] cannot read task log: %v", err)
+		return ""
+	}
+	start := total - taskLogTailLines
+	if start < 0 {
+		start = 0
+	}
+	entries, _, err := api.getPage(taskPath+"/log", start, taskLogTailLines)
+	if err != nil {
+		log.Printf("[DEBUG] cannot read task log: %v", err)
+		return ""
+	}
+	lines := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if line, isMap := entry.(map[string]interface{}); isMap {
+			lines = append(lines, fmt.Sprint(line["t"]))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Wait until the VM reaches the given status, and is not locked anymore by
+// an operation such as a clone or a disk move.
+func waitForVmStatus(api *apiClient, vmr *pxapi.VmRef, vmStatus string, dl deadline) error {
+	for {
+		data, err := api.get(vmPath(vmr)+"/status/current", nil)
+		if err != nil {
+			return err
+		}
+		current, _ := data.(map[string]interface{})
+		_, locked := current["lock"]
+		if !locked && (vmStatus == "" || current["status"] == vmStatus) {
+			return nil
+		}
+		if dl.expired() {
+			return dl.errorf("waiting for VM %d to be %s, currently %v (lock: %v)",
+				vmr.VmId(), vmStatus, current["status"], current["lock"])
+		}
+		time.Sleep(taskPollInterval)
+	}
+}
+
+func waitForVmUnlock(api *apiClient, vmr *pxapi.VmRef, dl deadline) error {
+	return waitForVmStatus(api, vmr, "", dl)
+}
+
+func cloneQemuVm(api *apiClient, sourceVmr *pxapi.VmRef, vmr *pxapi.VmRef, config *pxapi.ConfigQemu, dl deadline) error {
+	params := map[string]interface{}{
+		"newid":  vmr.VmId(),
+		"target": vmr.Node(),
+		"name":   config.Name,
+		"full":   true,
+	}
+	if disk0Storage, ok := config.QemuDisks[0]["storage"].(string); ok && disk0Storage != "" {
+		params["storage"] = disk0Storage
+	}
+	return runCreateTask(api, "POST", vmPath(sourceVmr)+"/clone", params, vmr, dl)
+}
+
+func startVm(api *apiClient, vmr *pxapi.VmRef, dl deadline) error {
+	return runTask(api, "POST", vmPath(vmr)+"/status/start", nil, dl)
+}
+
+func stopVm(api *apiClient, vmr *pxapi.VmRef, dl deadline) error {
+	return runTask(api, "POST", vmPath(vmr)+"/status/stop", nil, dl)
+}
+
+func suspendVm(api *apiClient, vmr *pxapi.VmRef, dl deadline) error {
+	return runTask(api, "POST", vmPath(vmr)+"/status/suspend", nil, dl)
+}
+
+func resumeVm(api *apiClient, vmr *pxapi.VmRef, dl deadline) error {
+	return runTask(api, "POST", vmPath(vmr)+"/status/resume", nil, dl)
+}
+
+// ACPI shutdown, falling back to a hard stop if the guest did not power off
+// within timeout seconds.
+func shutdownVm(api *apiClient, vmr *pxapi.VmRef, timeout int, dl deadline) error {
+	err := runTask(api, "POST", vmPath(vmr)+"/status/shutdown", map[string]interface{}{"timeout": timeout}, dl)
+	if err == nil {
+		return nil
+	}
+	if dl.expired() {
+		return err
+	}
+	log.Printf("[WARN] shutdown of VM %d failed, stopping it: %v", vmr.VmId(), err)
+	return stopVm(api, vmr, dl)
+}
+
+// Power state of a VM as returned by GetVmState: running, stopped or paused.
+func powerState(vmState map[string]interface{}) string {
+	if vmState["qmpstatus"] == "paused" {
+		return "paused"
+	}
+	return fmt.Sprint(vmState["status"])
+}
+
+// Bring a VM from its current power state to the desired one.
+func setPowerState(client *pxapi.Client, api *apiClient, vmr *pxapi.VmRef, desired string, shutdownTimeout int, dl deadline) error {
+	vmState, err := client.GetVmState(vmr)
+	if err != nil {
+		return err
+	}
+	current := powerState(vmState)
+	if current == desired {
+		return nil
+	}
+	log.Printf("[DEBUG] changing power state of VM %d from %s to %s", vmr.VmId(), current, desired)
+
+	switch desired {
+	case "running":
+		if current == "paused" {
+			return resumeVm(api, vmr, dl)
+		}
+		err = startVm(api, vmr, dl)
+		if err != nil {
+			return err
+		}
+		return waitForVmStatus(api, vmr, "running", dl)
+	case "paused":
+		if current == "stopped" {
+			err = startVm(api, vmr, dl)
+			if err != nil {
+				return err
+			}
+		}
+		return suspendVm(api, vmr, dl)
+	case "stopped":
+		if current == "paused" {
+			// a paused guest cannot handle ACPI events
+			return stopVm(api, vmr, dl)
+		}
+		return shutdownVm(api, vmr, shutdownTimeout, dl)
+	}
+	return fmt.Errorf("Invalid power state: %s", desired)
+}
+
+// Delete a VM and its disks. With purge, its id is also removed from backup
+// jobs, replication jobs and HA.
+func deleteVm(api *apiClient, vmr *pxapi.VmRef, purge bool, dl deadline) error {
+	var params map[string]interface{}
+	if purge {
+		params = map[string]interface{}{"purge": true}
+	}
+	return runTask(api, "DELETE", vmPath(vmr), params, dl)
+}
+
+// Shutdown through the guest agent, falling back to a hard stop if the guest
+// did not power off within timeout seconds.
+func agentShutdownVm(api *apiClient, vmr *pxapi.VmRef, timeout int, dl deadline) error {
+	_, err := api.post(vmPath(vmr)+"/agent/shutdown", nil)
+	if err == nil {
+		shutdownDl := dl
+		if shutdownEnd := time.Now().Add(time.Duration(timeout) * time.Second); shutdownEnd.Before(dl.time) {
+			shutdownDl.time = shutdownEnd
+		}
+		err = waitForVmStatus(api, vmr, "stopped", shutdownDl)
+		if err == nil {
+			return nil
+		}
+	}
+	if dl.expired() {
+		return err
+	}
+	log.Printf("[WARN] guest agent shutdown of VM %d failed, stopping it: %v", vmr.VmId(), err)
+	return stopVm(api, vmr, dl)
+}
+
+// Back up a stopped VM with vzdump.
+func backupVm(api *apiClient, vmr *pxapi.VmRef, storage string, dl deadline) error {
+	params := map[string]interface{}{
+		"vmid":     vmr.VmId(),
+		"storage":  storage,
+		"mode":     "stop",
+		"compress": "zstd",
+	}
+	return runTask(api, "POST", fmt.Sprintf("/nodes/%s/vzdump", vmr.Node()), params, dl)
+}
+
+// Migrate a VM to targetNode, online if it is running.
+func migrateVm(api *apiClient, vmr *pxapi.VmRef, targetNode string, withLocalDisks bool, targetStorage string, dl deadline) error {
+	data, err := api.get(vmPath(vmr)+"/status/current", nil)
+	if err != nil {
+		return err
+	}
+	current, _ := data.(map[string]interface{})
+
+	params := map[string]interface{}{
+		"target": targetNode,
+		"online": current["status"] == "running",
+	}
+	if withLocalDisks {
+		params["with-local-disks"] = true
+		if targetStorage != "" {
+			params["targetstorage"] = targetStorage
+		}
+	}
+	return runTask(api, "POST", vmPath(vmr)+"/migrate", params, dl)
+}
+
+// POST on the configuration runs as a task, where PUT would block the request.
+func setQemuConfig(api *apiClient, vmr *pxapi.VmRef, params map[string]interface{}, dl deadline) error {
+	return runTask(api, "POST", vmPath(vmr)+"/config", params, dl)
+}
+
+func resizeVmDisk(api *apiClient, vmr *pxapi.VmRef, disk string, moreSizeGB int, dl deadline) error {
+	params := map[string]interface{}{
+		"disk": disk,
+		"size": fmt.Sprintf("+%dG", moreSizeGB),
+	}
+	return runTask(api, "PUT", vmPath(vmr)+"/resize", params, dl)
+}
+
+// Grow a volume to an absolute size, such as 10G.
+func resizeVmVolume(api *apiClient, vmr *pxapi.VmRef, disk string, size string, dl deadline) error {
+	params := map[string]interface{}{
+		"disk": disk,
+		"size": size,
+	}
+	return runTask(api, "PUT", vmPath(vmr)+"/resize", params, dl)
+}
+
+// Configuration changes accepted but not applied to the running VM, by key.
+// Keys that are pending removal have an empty value.
+func qemuPendingChanges(api *apiClient, vmr *pxapi.VmRef) (map[string]string, error) {
+	data, err := api.get(vmPath(vmr)+"/pending", nil)
+	if err != nil {
+		return nil, err
+	}
+	entries, _ := data.([]interface{})
+	pending := map[string]string{}
+	for _, entry := range entries {
+		entryMap, _ := entry.(map[string]interface{})
+		key, _ := entryMap["key"].(string)
+		if _, deleted := entryMap["delete"]; deleted {
+			pending[key] = ""
+		} else if value, ok := entryMap["pending"]; ok {
+			pending[key] = fmt.Sprint(value)
+		}
+	}
+	return pending, nil
+}
+
+// Shut the VM down and start it again, applying its pending changes.
+func rebootVm(api *apiClient, vmr *pxapi.VmRef, shutdownTimeout int, dl deadline) error {
+	err := shutdownVm(api, vmr, shutdownTimeout, dl)
+	if err != nil {
+		return err
+	}
+	err = startVm(api, vmr, dl)
+	if err != nil {
+		return err
+	}
+	return waitForVmStatus(api, vmr, "running", dl)
+}
+
+// Rebuild the cloud-init drive from the current configuration, which Proxmox
+// otherwise only does when the VM starts.
+func regenerateCloudInitDrive(api *apiClient, vmr *pxapi.VmRef, dl deadline) error {
+	return runTask(api, "PUT", vmPath(vmr)+"/cloudinit", nil, dl)
+}
@@ -0,0 +1,41 @@
+package proxmox
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseFingerprint(t *testing.T) {
+	pin := make([]byte, 32)
+	for i := range pin {
+		pin[i] = byte(0xa0 + i)
+	}
+	cases := []struct {
+		name        string
+		fingerprint string
+		pin         []byte
+	}{
+		{"colons", formatFingerprint(pin), pin},
+		{"lower case", "a0:a1:a2:a3:a4:a5:a6:a7:a8:a9:aa:ab:ac:ad:ae:af:b0:b1:b2:b3:b4:b5:b6:b7:b8:b9:ba:bb:bc:bd:be:bf", pin},
+		{"no colons", "A0A1A2A3A4A5A6A7A8A9AAABACADAEAFB0B1B2B3B4B5B6B7B8B9BABBBCBDBEBF", pin},
+		{"spaces around", " " + formatFingerprint(pin) + "\n", pin},
+		{"empty", "", nil},
+		{"sha1", "A0:A1:A2:A3:A4:A5:A6:A7:A8:A9:AA:AB:AC:AD:AE:AF:B0:B1:B2:B3", nil},
+		{"not hex", "Z0" + formatFingerprint(pin)[2:], nil},
+	}
+
+	for _, c := range cases {
+		pin, err := parseFingerprint(c.fingerprint)
+		if c.pin == nil {
+			if err == nil {
+				t.Errorf("%s: expected an error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		} else if !bytes.Equal(pin, c.pin) {
+			t.Errorf("%s: pin is %x, expected %x", c.name, pin, c.pin)
+		}
+	}
+}